@@ -0,0 +1,11 @@
+//go:build !unix
+
+package pacm
+
+import "os"
+
+// access is not checked on this platform, the directory is writable unless it is read-only
+func dirWritable(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.Mode().Perm()&0200 != 0
+}
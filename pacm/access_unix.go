@@ -0,0 +1,10 @@
+//go:build unix
+
+package pacm
+
+import "golang.org/x/sys/unix"
+
+// dirWritable checks write access of the user to the existing directory, nothing is created
+func dirWritable(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
@@ -0,0 +1,115 @@
+package pacm
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// archives of installed packages are cached here, PACMAN_CACHE_DIR overrides the path.
+// Users who can't write it cache archives in $XDG_CACHE_HOME/pacman (~/.cache/pacman).
+const defaultCacheDir = "/var/cache/pacman"
+
+// previous versions of a package kept for rollback, PACMAN_GENERATIONS overrides the number
+const defaultGenerations = 1
+
+func cacheDirPath() string {
+	if p := os.Getenv("PACMAN_CACHE_DIR"); p != "" {
+		return p
+	}
+	return systemOrUserCacheDir(defaultCacheDir)
+}
+
+// systemOrUserCacheDir chooses the per-user cache when the system one is not writable
+func systemOrUserCacheDir(system string) string {
+	if canWrite(system) {
+		return system
+	}
+	userDir, err := os.UserCacheDir()
+	if err != nil {
+		return system
+	}
+	p := filepath.Join(userDir, "pacman")
+	slog.Debug("System cache is not writable, per-user cache is used", "system", system, "path", p)
+	return p
+}
+
+func keptGenerations() int {
+	if v := os.Getenv("PACMAN_GENERATIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= 0 {
+			return n
+		}
+		slog.Warn("Invalid PACMAN_GENERATIONS, default is used", "value", v)
+	}
+	return defaultGenerations
+}
+
+// cached archive is stored as <cache>/<name>/<name>-<ver>.tar.gz
+func cachedArchivePath(cacheDir, name, ver string) string {
+	return filepath.Join(cacheDir, name, archiveFileName(name, ver))
+}
+
+// cacheArchive copies the downloaded archive to the cache
+func cacheArchive(cacheDir, name, ver, archivePath string) error {
+	dst := cachedArchivePath(cacheDir, name, ver)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	src, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".cache-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cached archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy archive to cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to copy archive to cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("failed to copy archive to cache: %w", err)
+	}
+	return nil
+}
+
+// pruneCache removes cached archives of the package which are neither installed nor kept generations
+func pruneCache(cacheDir string, pkg *InstalledPackage) {
+	if pkg == nil {
+		return
+	}
+	keep := map[string]bool{pkg.Ver: true}
+	for _, g := range pkg.Generations {
+		keep[g.Ver] = true
+	}
+
+	dir := filepath.Join(cacheDir, pkg.Name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	for _, ver := range versionsFromFileNames(pkg.Name, names) {
+		if keep[ver] {
+			continue
+		}
+		slog.Debug("Remove cached archive", "package", pkg.Name, "version", ver)
+		if err := os.Remove(cachedArchivePath(cacheDir, pkg.Name, ver)); err != nil {
+			slog.Warn("Failed to remove cached archive", "package", pkg.Name, "version", ver, "error", err)
+		}
+	}
+}
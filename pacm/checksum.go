@@ -0,0 +1,102 @@
+package pacm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// ChecksumError reports the archive which content does not match the published checksum
+type ChecksumError struct {
+	Path string
+	Want string
+	Got  string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected sha256 %s, got %s", e.Path, e.Want, e.Got)
+}
+
+// checksum of the archive is published next to it as <archive>.sha256 in sha256sum format
+func checksumPath(archivePath string) string {
+	return archivePath + ".sha256"
+}
+
+func formatChecksum(sum, archivePath string) []byte {
+	return fmt.Appendf(nil, "%s  %s\n", sum, path.Base(archivePath))
+}
+
+func parseChecksum(data []byte) (string, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	sum := strings.ToLower(fields[0])
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 checksum %q", fields[0])
+	}
+	return sum, nil
+}
+
+// upload checksum file of the local archive to the repository
+func publishChecksum(ctx context.Context, repo Repository, archivePath, sum string) error {
+	data := formatChecksum(sum, archivePath)
+	if err := repo.Upload(ctx, checksumPath(archivePath), bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to upload checksum: %w", err)
+	}
+	return nil
+}
+
+// download published checksum of the archive, empty if the archive has no checksum file
+func fetchChecksum(ctx context.Context, repo Repository, archivePath string) (string, error) {
+	p := checksumPath(archivePath)
+	if _, err := repo.Stat(ctx, p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to stat checksum file: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := repo.Fetch(ctx, p, &buf); err != nil {
+		return "", fmt.Errorf("failed to download checksum file: %w", err)
+	}
+	sum, err := parseChecksum(buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("checksum file %s: %w", p, err)
+	}
+	return sum, nil
+}
+
+func verifyChecksum(localPath, want string) error {
+	got, err := fileSHA256(localPath)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return &ChecksumError{Path: localPath, Want: want, Got: got}
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
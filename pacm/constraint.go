@@ -0,0 +1,250 @@
+package pacm
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Constraint is a parsed version constraint: alternatives separated by "||",
+// each alternative is a set of comparators that all must match.
+//
+//	1.2.3         exact version
+//	>=1.2, <2.0   compound range, comparators are separated by comma or space
+//	^1.4          >=1.4.0, <2.0.0   (^0.4 is >=0.4.0, <0.5.0)
+//	~1.4.2        >=1.4.2, <1.5.0   (~1 is >=1.0.0, <2.0.0)
+//	1.x, 1.2.*    >=1.0.0, <2.0.0 and >=1.2.0, <1.3.0; "*" or empty matches any version
+//	!=1.3         any version except 1.3
+//	^1.0 || ^2.0  any of alternatives
+type Constraint struct {
+	alts [][]comparator
+}
+
+type comparator struct {
+	op  string // one of = != > >= < <=
+	ver Version
+
+	// user written pre-release version: pre-releases of the same release match the comparator set
+	allowPre bool
+}
+
+func (cmp comparator) match(v Version) bool {
+	c := v.Compare(cmp.ver)
+	switch cmp.op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case "!=":
+		return c != 0
+	default:
+		return c == 0
+	}
+}
+
+// operators in order of matching, longer first
+var constraintOps = []string{">=", "<=", "!=", ">", "<", "^", "~"}
+
+func parseConstraint(s string) (*Constraint, error) {
+	var c Constraint
+	alts := strings.Split(s, "||")
+	for _, alt := range alts {
+		if len(alts) > 1 && strings.TrimSpace(alt) == "" {
+			return nil, fmt.Errorf("invalid version constraint %q: empty alternative", s)
+		}
+		cmps, err := parseComparatorSet(alt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", s, err)
+		}
+		c.alts = append(c.alts, cmps)
+	}
+	return &c, nil
+}
+
+func parseComparatorSet(s string) ([]comparator, error) {
+	// join operators separated from versions by space: ">= 1.2"
+	var tokens []string
+	for _, f := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		if n := len(tokens); n > 0 && isConstraintOp(tokens[n-1]) {
+			tokens[n-1] += f
+			continue
+		}
+		tokens = append(tokens, f)
+	}
+	if len(tokens) == 0 {
+		if strings.Contains(s, ",") {
+			return nil, fmt.Errorf("empty comparator")
+		}
+		return nil, nil // any version
+	}
+
+	var cmps []comparator
+	for _, tok := range tokens {
+		parsed, err := parseComparator(tok)
+		if err != nil {
+			return nil, err
+		}
+		cmps = append(cmps, parsed...)
+	}
+	return cmps, nil
+}
+
+func isConstraintOp(s string) bool {
+	for _, op := range constraintOps {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+func parseComparator(tok string) ([]comparator, error) {
+	op := ""
+	for _, o := range constraintOps {
+		if strings.HasPrefix(tok, o) {
+			op = o
+			break
+		}
+	}
+	verStr := strings.TrimPrefix(tok, op)
+	if verStr == "" {
+		return nil, fmt.Errorf("operator %q without version", op)
+	}
+
+	release, wildcard, err := parseWildcard(verStr)
+	if err != nil {
+		return nil, err
+	}
+	if wildcard {
+		if op != "" {
+			return nil, fmt.Errorf("wildcard %q can't be used with operator %q", verStr, op)
+		}
+		if len(release) == 0 {
+			return nil, nil // "*" matches any version
+		}
+		return rangeOf(release, len(release)-1), nil
+	}
+
+	ver, err := parseVersion(verStr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "^":
+		// bump the first non zero part
+		i := len(ver.Release) - 1
+		for j, n := range ver.Release {
+			if n != 0 {
+				i = j
+				break
+			}
+		}
+		return boundedRange(ver, i), nil
+	case "~":
+		i := 0
+		if len(ver.Release) > 1 {
+			i = 1
+		}
+		return boundedRange(ver, i), nil
+	case "":
+		op = "="
+	}
+	return []comparator{{op: op, ver: ver, allowPre: ver.IsPrerelease()}}, nil
+}
+
+// parse "1.2.x", "1.*", "*". Returns numeric parts before the first wildcard.
+func parseWildcard(s string) (release []int, wildcard bool, err error) {
+	for _, part := range strings.Split(s, ".") {
+		if part == "x" || part == "X" || part == "*" {
+			wildcard = true
+			continue
+		}
+		if !wildcard {
+			n, convErr := strconv.Atoi(part)
+			if convErr != nil || n < 0 {
+				return nil, false, nil // not a wildcard, checked by parseVersion
+			}
+			release = append(release, n)
+			continue
+		}
+		return nil, false, fmt.Errorf("invalid wildcard version %q", s)
+	}
+	return release, wildcard, nil
+}
+
+// >=ver, <next where next has part i of ver incremented
+func boundedRange(ver Version, i int) []comparator {
+	upper := Version{Release: append([]int(nil), ver.Release[:i+1]...), Pre: []string{"0"}}
+	upper.Release[i]++
+	return []comparator{
+		{op: ">=", ver: ver, allowPre: ver.IsPrerelease()},
+		{op: "<", ver: upper},
+	}
+}
+
+func rangeOf(release []int, i int) []comparator {
+	return boundedRange(Version{Release: release}, i)
+}
+
+// Match reports whether the version satisfies the constraint.
+// Pre-release versions match only if prerelease is set or a comparator of the
+// alternative has a pre-release of the same release, e.g. >=1.2.0-rc1 matches 1.2.0-rc2 but not 1.3.0-rc1.
+func (c *Constraint) Match(v Version, prerelease bool) bool {
+	for _, cmps := range c.alts {
+		if matchComparatorSet(cmps, v, prerelease) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComparatorSet(cmps []comparator, v Version, prerelease bool) bool {
+	for _, cmp := range cmps {
+		if !cmp.match(v) {
+			return false
+		}
+	}
+	if !v.IsPrerelease() || prerelease {
+		return true
+	}
+	for _, cmp := range cmps {
+		if cmp.allowPre && compareRelease(cmp.ver.Release, v.Release) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether the constraint has an alternative without comparators
+func (c *Constraint) matchAny() bool {
+	for _, cmps := range c.alts {
+		if len(cmps) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion checks the actual version against the required one, pre-releases are excluded
+func checkVersion(requiredVer, actualVer string) bool {
+	return matchVersion(requiredVer, actualVer, false)
+}
+
+func matchVersion(requiredVer, actualVer string, prerelease bool) bool {
+	c, err := parseConstraint(requiredVer)
+	if err != nil {
+		slog.Warn("checkVersion: invalid version constraint", "error", err)
+		return false
+	}
+	actual, err := parseVersion(actualVer)
+	if err != nil {
+		return c.matchAny() // no need version check
+	}
+	return c.Match(actual, prerelease)
+}
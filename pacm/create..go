@@ -4,21 +4,28 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	scp "github.com/bramvdbogaerde/go-scp"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
-func (pm *PackageManager) CreatePackage(ctx context.Context, configPath string) error {
+// CreateOptions tune pm create
+type CreateOptions struct {
+	Signer ssh.Signer // sign published archive if set
+}
+
+func (pm *PackageManager) CreatePackage(ctx context.Context, configPath string, opts CreateOptions) error {
 	slog.Info("Start create package...")
 	startTime := time.Now()
 
@@ -34,36 +41,24 @@ func (pm *PackageManager) CreatePackage(ctx context.Context, configPath string)
 		return fmt.Errorf("failed to create archive for upload: %w", err)
 	}
 
-	// Upload to server
-	sshClient, err := ssh.Dial("tcp", pm.server, pm.sshConfig)
+	ver, err := getVersionFromArchiveName(archiveName, packName)
 	if err != nil {
-		return fmt.Errorf("failed to connect to SSH server: %w", err)
+		return err
 	}
-	defer sshClient.Close()
-
-	// Create remote directory
-	remoteDir := fmt.Sprintf("%s/%s", os.Getenv("PACMAN_ROOT_DIR"), packName)
-
-	session, err := sshClient.NewSession()
+	meta, err := readManifest(archiveName, packName, ver)
 	if err != nil {
-		return fmt.Errorf("can't create SSH session: %w", err)
+		return err
 	}
-	defer session.Close()
-
-	err = session.Run(fmt.Sprintf("mkdir -p %s", remoteDir))
+	sum, err := fileSHA256(archiveName)
 	if err != nil {
-		return fmt.Errorf("can't create remote dir %s on server: %w", remoteDir, err)
+		return err
 	}
-
-	// Create a new SCP client, note that this function might
-	// return an error, as a new SSH session is established using the existing connecton
-
-	client, err := scp.NewClientBySSH(sshClient)
-	if err != nil {
-		slog.Error("Error creating new SSH session from existing connection", "error", err)
-		return fmt.Errorf("error creating new SSH session from existing connection: %w", err)
+	var sig *PackageSignature
+	if opts.Signer != nil {
+		if sig, err = signPackage(opts.Signer, packName, ver, sum); err != nil {
+			return err
+		}
 	}
-	defer client.Close()
 
 	archiveData, err := os.Open(archiveName)
 	if err != nil {
@@ -71,12 +66,49 @@ func (pm *PackageManager) CreatePackage(ctx context.Context, configPath string)
 	}
 	defer archiveData.Close()
 
-	remotePath := fmt.Sprintf("%s/%s", remoteDir, archiveName)
+	info, err := archiveData.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %w", err)
+	}
 
-	err = client.CopyFromFile(ctx, *archiveData, remotePath, "0655")
+	// republished version is withdrawn first: consumers never see the new archive
+	// with the old checksum or signature, an unsigned republish drops the old signature
+	repoPath := path.Join(packName, archiveName)
+	if err := unpublishFromIndex(ctx, pm.repo, packName, ver); err != nil {
+		return fmt.Errorf("failed to update repository index: %w", err)
+	}
+	for _, p := range []string{checksumPath(repoPath), signaturePath(repoPath)} {
+		if err := deleteIfExists(ctx, pm.repo, p); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", p, err)
+		}
+	}
 
+	// Upload to repository
+	err = pm.repo.Upload(ctx, repoPath, archiveData, info.Size())
 	if err != nil {
-		slog.Error("Error while copying file ", "error", err)
+		return fmt.Errorf("failed to upload archive: %w", err)
+	}
+
+	// publish checksum, signature and version to the repository index
+	if err := publishChecksum(ctx, pm.repo, repoPath, sum); err != nil {
+		return err
+	}
+	if sig != nil {
+		if err := publishSignature(ctx, pm.repo, repoPath, sig); err != nil {
+			return err
+		}
+		slog.Info("Package is signed", "key", ssh.FingerprintSHA256(opts.Signer.PublicKey()))
+	}
+	err = publishToIndex(ctx, pm.repo, packName, IndexVersion{
+		Ver:       ver,
+		Archive:   repoPath,
+		Size:      info.Size(),
+		SHA256:    sum,
+		Packets:   meta.Packets,
+		Published: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update repository index: %w", err)
 	}
 	slog.Info("Finish create package", "time", time.Since(startTime))
 
@@ -85,26 +117,13 @@ func (pm *PackageManager) CreatePackage(ctx context.Context, configPath string)
 
 // Create compressed package file
 func getArch(ctx context.Context, configPath string) (packName, archiveName string, err error) {
-
-	configData, err := os.ReadFile(configPath)
-	if err != nil {
-		err = fmt.Errorf("failed to read config: %w", err)
-		return
-	}
-
-	var config PackageConfig
-	if strings.HasSuffix(configPath, ".yaml") || strings.HasSuffix(configPath, ".yml") {
-		err = yaml.Unmarshal(configData, &config)
-	} else {
-		err = json.Unmarshal(configData, &config)
-	}
+	config, err := readPackageConfig(configPath)
 	if err != nil {
-		err = fmt.Errorf("failed to parse config: %w", err)
 		return
 	}
 
 	packName = config.Name
-	archiveName = fmt.Sprintf("%s-%s.tar.gz", config.Name, config.Ver)
+	archiveName = archiveFileName(config.Name, config.Ver)
 
 	archiveFile, err := os.Create(archiveName)
 	if err != nil {
@@ -117,6 +136,8 @@ func getArch(ctx context.Context, configPath string) (packName, archiveName stri
 	defer gw.Close()
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
+	links := make(map[fileKey]string) // archived files with several hard links
+	manifest := newManifest(config)
 
 	for _, target := range config.Targets {
 		select {
@@ -126,79 +147,213 @@ func getArch(ctx context.Context, configPath string) (packName, archiveName stri
 		default:
 		}
 
-		root := filepath.Dir(target.Path)
-		mask := filepath.Base(target.Path)
-
-		err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		var files []targetFile
+		files, err = target.files()
+		if err != nil {
+			err = fmt.Errorf("failed to add files to archive: %w", err)
+			return
+		}
+		for _, tf := range files {
+			var f ManifestFile
+			f, err = addFileToTar(tw, tf.path, tf.name, tf.info, links)
 			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
+				err = fmt.Errorf("failed to add files to archive: %w", err)
+				return
 			}
+			manifest.Files = append(manifest.Files, f)
+		}
+	}
+	err = manifest.writeTo(tw)
 
-			for _, exclude := range strings.Split(target.Exclude, ",") {
-				ok, err := filepath.Match(exclude, filepath.Base(filePath))
-				if ok {
-					return nil
-				}
-				if err != nil {
-					return fmt.Errorf("error match exclude: %w", err)
-				}
-			}
+	return
+}
+
+// read package config and check versions of the package and its dependencies
+func readPackageConfig(configPath string) (*PackageConfig, error) {
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
 
-			ok, err := filepath.Match(mask, filepath.Base(filePath))
-			if !ok {
+	var config PackageConfig
+	if strings.HasSuffix(configPath, ".yaml") || strings.HasSuffix(configPath, ".yml") {
+		err = yaml.Unmarshal(configData, &config)
+	} else {
+		err = json.Unmarshal(configData, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if err := validatePackageName(config.Name); err != nil {
+		return nil, err
+	}
+	if _, err := parseVersion(config.Ver); err != nil {
+		return nil, fmt.Errorf("invalid package version: %w", err)
+	}
+	for _, p := range config.Packets {
+		if err := validatePacket(p); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// targetFile is a file matched by the target
+type targetFile struct {
+	path string // path of the file on disk
+	name string // name in the archive
+	info os.FileInfo
+}
+
+// files matching the target mask which are not excluded, in walk order
+func (t *Target) files() ([]targetFile, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	root := filepath.Dir(t.Path)
+	mask := filepath.Base(t.Path)
+
+	var files []targetFile
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filePath == root {
+			return nil
+		}
+
+		for _, exclude := range strings.Split(t.Exclude, ",") {
+			ok, err := filepath.Match(exclude, filepath.Base(filePath))
+			if ok {
 				return nil
 			}
 			if err != nil {
 				return fmt.Errorf("error match exclude: %w", err)
 			}
+		}
 
-			return addFileToTar(tw, filePath, info)
-		})
+		ok, err := filepath.Match(mask, filepath.Base(filePath))
+		if !ok {
+			return nil
+		}
 		if err != nil {
-			err = fmt.Errorf("failed to add files to archive: %w", err)
-			return
+			return fmt.Errorf("error match exclude: %w", err)
+		}
+
+		name, err := t.entryName(filePath)
+		if err != nil {
+			return err
+		}
+		if isManifestEntry(name) {
+			return fmt.Errorf("file %s: %s/ is reserved for the package manifest", filePath, manifestDir)
+		}
+		files = append(files, targetFile{path: filePath, name: name, info: info})
+		return nil
+	})
+	return files, err
+}
+
+// add file, directory or symlink to the archive with its mode, mtime and owner.
+// Second and next names of a hard linked file are stored as links to the first one.
+// Returns the manifest record of the entry.
+func addFileToTar(tw *tar.Writer, filePath, name string, info os.FileInfo, links map[fileKey]string) (ManifestFile, error) {
+	f := ManifestFile{Path: name, Mode: fileMode(info)}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(filePath); err != nil {
+			return f, fmt.Errorf("failed to read symlink %s: %v", filePath, err)
 		}
 	}
-	metaPath := fmt.Sprintf("meta-%s-%s.json", config.Name, config.Ver)
 
-	// copy config file to meta file
-	err = os.WriteFile(metaPath, configData, 0644)
+	header, err := tar.FileInfoHeader(info, link)
 	if err != nil {
-		slog.Error("Error creating meta file", "file", metaPath, "error", err)
-		return
+		return f, fmt.Errorf("failed to create tar header for %s: %v", filePath, err)
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
 	}
 
-	metaInfo, err := os.Stat(metaPath)
-	if err != nil {
-		err = fmt.Errorf("failed to get file info for meta file %s: %w", metaPath, err)
-		return
+	if info.Mode().IsRegular() {
+		if key, ok := hardlinkKey(info); ok {
+			if first, ok := links[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[key] = name
+			}
+		}
 	}
-	err = addFileToTar(tw, metaPath, metaInfo)
 
-	return
-}
+	if err := tw.WriteHeader(header); err != nil {
+		return f, fmt.Errorf("failed to write tar header for %s: %v", filePath, err)
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		f.Type = fileTypeDir
+	case tar.TypeSymlink:
+		f.Type, f.Link = fileTypeSymlink, header.Linkname
+	case tar.TypeLink:
+		f.Type, f.Link = fileTypeHardlink, header.Linkname
+	}
+	if header.Typeflag != tar.TypeReg {
+		slog.Debug("add entry", "name", name, "type", string(header.Typeflag), "link", header.Linkname)
+		return f, nil
+	}
 
-func addFileToTar(tw *tar.Writer, filePath string, info os.FileInfo) error {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %v", filePath, err)
+		return f, fmt.Errorf("failed to open file %s: %v", filePath, err)
 	}
 	defer file.Close()
 
-	header, err := tar.FileInfoHeader(info, "")
-	if err != nil {
-		return fmt.Errorf("failed to create tar header for %s: %v", filePath, err)
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tw, h), file)
+	slog.Debug("add file", "size", size, "name", name, "file", filePath)
+	f.Type, f.Size, f.SHA256 = fileTypeRegular, size, hex.EncodeToString(h.Sum(nil))
+	return f, err
+}
+
+// name of the file in archive is relative: files of the working directory are stored
+// relative to it, other files by absolute path without leading slash
+func archiveEntryName(filePath string) string {
+	name := filepath.Clean(filePath)
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
 	}
-	header.Name = filePath
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, name); err == nil && filepath.IsLocal(rel) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	name = strings.TrimPrefix(name, filepath.VolumeName(name))
+	return strings.TrimLeft(filepath.ToSlash(name), "/")
+}
 
-	if err := tw.WriteHeader(header); err != nil {
-		return fmt.Errorf("failed to write tar header for %s: %v", filePath, err)
+func (t *Target) validate() error {
+	if t.Dest != "" && !filepath.IsLocal(filepath.FromSlash(t.Dest)) {
+		return fmt.Errorf("target %s: dest %q must be a relative path inside the package", t.Path, t.Dest)
+	}
+	return nil
+}
+
+// entryName maps the matched file into the package: strip_prefix is removed and dest is prepended.
+// Targets without dest and strip_prefix keep the path of the file.
+func (t *Target) entryName(filePath string) (string, error) {
+	if t.Dest == "" && t.StripPrefix == "" {
+		return archiveEntryName(filePath), nil
 	}
 
-	size, err := io.Copy(tw, file)
-	slog.Debug("add file", "size", size, "name", filePath)
-	return err
+	strip := t.StripPrefix
+	if strip == "" {
+		strip = filepath.Dir(t.Path)
+	}
+	rel, err := filepath.Rel(filepath.Clean(strip), filepath.Clean(filePath))
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file %s is not under strip_prefix %s", filePath, strip)
+	}
+	return path.Join(filepath.ToSlash(t.Dest), filepath.ToSlash(rel)), nil
 }
@@ -0,0 +1,194 @@
+package pacm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// DepsOptions tune output of pm deps
+type DepsOptions struct {
+	Prerelease bool   // allow pre-release versions to match version ranges
+	Reverse    string // show packages which depend on this package
+	Format     string // tree or dot
+}
+
+// DepGraph is the resolved dependency graph of packages.json or of a single package
+type DepGraph struct {
+	Root     string   // config path or package spec the graph is resolved for
+	Packages []Packet // requirements of the root
+	Nodes    map[string]*resolvedPacket
+}
+
+// depEdge is a requirement of the dependent package, from is empty for requirements of the root
+type depEdge struct {
+	from, to string
+	ver      string // version constraint
+}
+
+// Deps resolves dependencies of the packages config or of the package spec name[@constraint]
+// the same way as pm update does.
+func (pm *PackageManager) Deps(ctx context.Context, arg string, opts DepsOptions) (*DepGraph, error) {
+	graph := &DepGraph{Root: arg, Nodes: make(map[string]*resolvedPacket)}
+	if _, err := os.Stat(arg); err == nil || isConfigPath(arg) {
+		config, err := readPackagesConfig(arg)
+		if err != nil {
+			return nil, err
+		}
+		graph.Packages = config.Packages
+	} else {
+		pkg, err := parsePacketSpec(arg)
+		if err != nil {
+			return nil, err
+		}
+		graph.Packages = []Packet{pkg}
+	}
+
+	// archives are streamed to read their manifests, nothing is saved
+	src := newRepoSource(pm.repo)
+	src.stream = true
+	slv := newSolver(src)
+	slv.prerelease = opts.Prerelease
+	packets, err := slv.resolve(ctx, graph.Packages, arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve dependencies: %w", err)
+	}
+	for _, rp := range packets {
+		graph.Nodes[rp.Name] = rp
+	}
+	return graph, nil
+}
+
+func isConfigPath(p string) bool {
+	return strings.HasSuffix(p, ".json") || strings.HasSuffix(p, ".yaml") || strings.HasSuffix(p, ".yml")
+}
+
+// Print writes the graph as a tree or in Graphviz dot format
+func (g *DepGraph) Print(w io.Writer, opts DepsOptions) error {
+	edges := g.edges()
+	if opts.Reverse != "" {
+		if g.Nodes[opts.Reverse] == nil {
+			return fmt.Errorf("package %s is not in the dependency graph of %s", opts.Reverse, g.Root)
+		}
+		edges = dependentEdges(edges, opts.Reverse)
+	}
+
+	switch opts.Format {
+	case "", "tree":
+		if opts.Reverse != "" {
+			g.printReverse(w, edges, opts.Reverse, "")
+		} else {
+			fmt.Fprintln(w, g.Root)
+			g.printTree(w, edges, "", "  ", make(map[string]bool))
+		}
+	case "dot":
+		g.printDot(w, edges)
+	default:
+		return fmt.Errorf("unknown format %q, use tree or dot", opts.Format)
+	}
+	return nil
+}
+
+// edges of the graph in order of requirements
+func (g *DepGraph) edges() []depEdge {
+	var edges []depEdge
+	for _, p := range g.Packages {
+		edges = append(edges, depEdge{to: p.Name, ver: p.Ver})
+	}
+	for _, rp := range g.sortedNodes() {
+		for _, p := range rp.Packets {
+			edges = append(edges, depEdge{from: rp.Name, to: p.Name, ver: p.Ver})
+		}
+	}
+	return edges
+}
+
+// nodes ordered by name, output doesn't depend on map order
+func (g *DepGraph) sortedNodes() []*resolvedPacket {
+	nodes := make([]*resolvedPacket, 0, len(g.Nodes))
+	for _, rp := range g.Nodes {
+		nodes = append(nodes, rp)
+	}
+	slices.SortFunc(nodes, func(a, b *resolvedPacket) int { return strings.Compare(a.Name, b.Name) })
+	return nodes
+}
+
+// edges on the paths from the root to the package
+func dependentEdges(edges []depEdge, name string) []depEdge {
+	reach := map[string]bool{name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, e := range edges {
+			if e.from != "" && reach[e.to] && !reach[e.from] {
+				reach[e.from] = true
+				changed = true
+			}
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(edges), func(e depEdge) bool {
+		return !reach[e.to]
+	})
+}
+
+// tree of requirements with constraints and chosen versions, repeated subtrees are printed once
+func (g *DepGraph) printTree(w io.Writer, edges []depEdge, from, indent string, shown map[string]bool) {
+	for _, e := range edges {
+		if e.from != from {
+			continue
+		}
+		rp := g.Nodes[e.to]
+		fmt.Fprintf(w, "%s%s %s -> %s", indent, e.to, constraintText(e.ver), rp.Ver)
+		if shown[e.to] && len(rp.Packets) > 0 {
+			fmt.Fprintln(w, " (see above)")
+			continue
+		}
+		fmt.Fprintln(w)
+		shown[e.to] = true
+		g.printTree(w, edges, e.to, indent+"  ", shown)
+	}
+}
+
+// tree of dependents from the package up to the root, the graph has no cycles
+func (g *DepGraph) printReverse(w io.Writer, edges []depEdge, name, indent string) {
+	if indent == "" {
+		fmt.Fprintf(w, "%s %s\n", name, g.Nodes[name].Ver)
+	}
+	indent += "  "
+	for _, e := range edges {
+		if e.to != name {
+			continue
+		}
+		if e.from == "" {
+			fmt.Fprintf(w, "%s%s requires %s\n", indent, g.Root, constraintText(e.ver))
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s requires %s\n", indent, e.from, g.Nodes[e.from].Ver, constraintText(e.ver))
+		g.printReverse(w, edges, e.from, indent)
+	}
+}
+
+func (g *DepGraph) printDot(w io.Writer, edges []depEdge) {
+	node := func(name string) string {
+		if name == "" {
+			return g.Root
+		}
+		return name + " " + g.Nodes[name].Ver
+	}
+	fmt.Fprintln(w, "digraph deps {")
+	fmt.Fprintf(w, "  %q [shape=box];\n", g.Root)
+	for _, e := range edges {
+		fmt.Fprintf(w, "  %q -> %q [label=%q];\n", node(e.from), node(e.to), constraintText(e.ver))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// any version is shown as *
+func constraintText(ver string) string {
+	if strings.TrimSpace(ver) == "" {
+		return "*"
+	}
+	return ver
+}
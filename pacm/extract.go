@@ -0,0 +1,318 @@
+package pacm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// default limit of total decompressed size of one archive, protects from gzip bombs
+const defaultMaxUnpackSize int64 = 1 << 30
+
+// ErrUnsafePath is returned for archive entries which would be written outside the install root
+var ErrUnsafePath = errors.New("unsafe path in archive")
+
+// extractor unpacks package archives confined to the install root
+type extractor struct {
+	root    string
+	maxSize int64 // limit of total decompressed size, defaultMaxUnpackSize if 0
+	owner   bool  // restore owner of files, only when running as root
+}
+
+func newExtractor(root string, maxSize int64) *extractor {
+	if maxSize <= 0 {
+		maxSize = defaultMaxUnpackSize
+	}
+	return &extractor{root: root, maxSize: maxSize}
+}
+
+// unpack .tar.gz archive to the install root, returns unpacked entries
+func (e *extractor) extract(archivePath string) ([]InstalledFile, error) {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archiveFile.Close()
+
+	gr, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gr.Close()
+
+	if err := os.MkdirAll(e.root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create install root: %w", err)
+	}
+	root, err := filepath.Abs(e.root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve install root: %w", err)
+	}
+
+	var files []InstalledFile
+	var dirs []*tar.Header // mode and mtime of directories are set after their files are written
+	var manifest *Manifest
+	remain := e.maxSize
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar: %w", err)
+		}
+
+		name, err := entryName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue // "./" entry of archives made with tar -C dir . is the root itself
+		}
+		if isManifestEntry(name) {
+			if name == manifestPath && header.Typeflag == tar.TypeReg {
+				if manifest, err = parseManifest(tr); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		outPath := filepath.Join(root, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := checkInRoot(root, outPath); err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(outPath, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create directory: %w", err)
+			}
+			dirs = append(dirs, header)
+			files = append(files, InstalledFile{Path: name, Type: fileTypeDir, Mode: e.mode(header)})
+			continue
+		case tar.TypeReg:
+			if header.Size > remain {
+				return nil, fmt.Errorf("archive exceeds unpack size limit of %d bytes", e.maxSize)
+			}
+			if err := checkInRoot(root, filepath.Dir(outPath)); err != nil {
+				return nil, err
+			}
+			n, sum, err := writeEntry(outPath, tr, remain, e.mode(header))
+			if err != nil {
+				return nil, err
+			}
+			if n > remain {
+				return nil, fmt.Errorf("archive exceeds unpack size limit of %d bytes", e.maxSize)
+			}
+			remain -= n
+			if err := os.Chtimes(outPath, header.AccessTime, header.ModTime); err != nil {
+				return nil, fmt.Errorf("failed to set mtime of %s: %w", name, err)
+			}
+			files = append(files, InstalledFile{Path: name, Type: fileTypeRegular, Mode: e.mode(header), SHA256: sum})
+		case tar.TypeSymlink:
+			// symlink must point inside the root, absolute targets are refused
+			target := path.Join(path.Dir(name), header.Linkname)
+			if path.IsAbs(header.Linkname) || !filepath.IsLocal(filepath.FromSlash(target)) {
+				return nil, fmt.Errorf("%w: symlink %s -> %s points outside of the root", ErrUnsafePath, name, header.Linkname)
+			}
+			if err := e.prepare(root, outPath); err != nil {
+				return nil, err
+			}
+			// parent may be reached through symlinks extracted before, the target is checked from the real directory
+			parent, err := filepath.EvalSymlinks(filepath.Dir(outPath))
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve directory of %s: %w", name, err)
+			}
+			if rel, err := filepath.Rel(root, filepath.Join(parent, filepath.FromSlash(header.Linkname))); err != nil || !filepath.IsLocal(rel) {
+				return nil, fmt.Errorf("%w: symlink %s -> %s points outside of the root", ErrUnsafePath, name, header.Linkname)
+			}
+			if err := os.Symlink(header.Linkname, outPath); err != nil {
+				return nil, fmt.Errorf("failed to create symlink: %w", err)
+			}
+			files = append(files, InstalledFile{Path: name, Type: fileTypeSymlink, Link: header.Linkname})
+		case tar.TypeLink:
+			target, err := entryName(header.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			targetPath := filepath.Join(root, filepath.FromSlash(target))
+			if err := checkInRoot(root, filepath.Dir(targetPath)); err != nil {
+				return nil, err
+			}
+			if err := e.prepare(root, outPath); err != nil {
+				return nil, err
+			}
+			if err := os.Link(targetPath, outPath); err != nil {
+				return nil, fmt.Errorf("failed to create hard link: %w", err)
+			}
+			files = append(files, InstalledFile{Path: name, Type: fileTypeHardlink, Link: target})
+		default:
+			slog.Warn("Skip unsupported archive entry", "name", header.Name, "type", string(header.Typeflag))
+			continue
+		}
+
+		if err := e.chown(outPath, header); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, header := range slices.Backward(dirs) {
+		outPath := filepath.Join(root, filepath.FromSlash(path.Clean(header.Name)))
+		if err := e.chown(outPath, header); err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(outPath, e.mode(header)); err != nil {
+			return nil, fmt.Errorf("failed to set mode of %s: %w", header.Name, err)
+		}
+		if err := os.Chtimes(outPath, header.AccessTime, header.ModTime); err != nil {
+			return nil, fmt.Errorf("failed to set mtime of %s: %w", header.Name, err)
+		}
+	}
+
+	// archives created before manifests are not checked
+	if manifest != nil {
+		if err := manifest.check(files); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// mode of unpacked file, setuid and setgid bits are kept only with owner restoring
+func (e *extractor) mode(header *tar.Header) os.FileMode {
+	mode := fileMode(header.FileInfo())
+	if !e.restoreOwner() {
+		mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	return mode
+}
+
+func (e *extractor) restoreOwner() bool {
+	return e.owner && os.Geteuid() == 0
+}
+
+func (e *extractor) chown(outPath string, header *tar.Header) error {
+	if !e.restoreOwner() {
+		return nil
+	}
+	if err := os.Lchown(outPath, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("failed to restore owner of %s: %w", outPath, err)
+	}
+	// chown drops setuid bits of files
+	if header.Typeflag == tar.TypeReg {
+		return os.Chmod(outPath, e.mode(header))
+	}
+	return nil
+}
+
+// prepare the place of symlink or hard link, existing file is replaced
+func (e *extractor) prepare(root, outPath string) error {
+	if err := checkInRoot(root, filepath.Dir(outPath)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+	if info, err := os.Lstat(outPath); err == nil && !info.IsDir() {
+		if err := os.Remove(outPath); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", outPath, err)
+		}
+	}
+	return nil
+}
+
+// entryName validates the name of archive entry, it must be relative and stay inside the root
+func entryName(name string) (string, error) {
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	for elem := range strings.SplitSeq(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// checkInRoot makes sure that dir does not leave the root by existing symlinks
+func checkInRoot(root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%w: %s is outside of %s", ErrUnsafePath, dir, root)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	cur := root
+	for elem := range strings.SplitSeq(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, elem)
+		info, err := os.Lstat(cur)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // the rest is created by MkdirAll
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", cur)
+			}
+			continue
+		}
+
+		resolved, err := filepath.EvalSymlinks(cur)
+		if err != nil {
+			return fmt.Errorf("failed to resolve symlink %s: %w", cur, err)
+		}
+		if r, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(r) {
+			return fmt.Errorf("%w: symlink %s points outside of %s", ErrUnsafePath, cur, root)
+		}
+	}
+	return nil
+}
+
+// write regular file of archive, writing stops after limit bytes.
+// Existing file is removed first, so symlinks and hard links are not written through.
+func writeEntry(outPath string, r io.Reader, limit int64, mode os.FileMode) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	if info, err := os.Lstat(outPath); err == nil && !info.IsDir() {
+		if err := os.Remove(outPath); err != nil {
+			return 0, "", fmt.Errorf("failed to replace file: %w", err)
+		}
+	}
+
+	outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	h := sha256.New()
+	n, err := io.CopyN(io.MultiWriter(outFile, h), r, limit+1)
+	if err != nil && err != io.EOF {
+		return n, "", fmt.Errorf("failed to write output file: %w", err)
+	}
+	// mode is set explicitly, umask is not applied
+	if err := outFile.Chmod(mode); err != nil {
+		return n, "", fmt.Errorf("failed to set mode of output file: %w", err)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), outFile.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package pacm
+
+import "os"
+
+// fileKey identifies the file with several hard links
+type fileKey struct {
+	dev, ino uint64
+}
+
+// hard links are not detected on this platform, files are archived as separate copies
+func hardlinkKey(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package pacm
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileKey identifies the file with several hard links
+type fileKey struct {
+	dev, ino uint64
+}
+
+func hardlinkKey(info os.FileInfo) (fileKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,188 @@
+package pacm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// index of the repository is stored in the repository root
+const indexFileName = "index.json"
+
+// publishers of the repository take the lock while they update the index
+const (
+	indexLockName    = indexFileName + ".lock"
+	indexLockTimeout = 30 * time.Second
+	indexLockRetry   = 100 * time.Millisecond
+)
+
+// RepoIndex lists packages and versions of the repository
+type RepoIndex struct {
+	Packages map[string]*IndexPackage `json:"packages"`
+}
+
+type IndexPackage struct {
+	Versions []IndexVersion `json:"versions"`
+}
+
+type IndexVersion struct {
+	Ver       string    `json:"ver"`
+	Archive   string    `json:"archive"` // path of the archive relative to the repository root
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Packets   []Packet  `json:"packets,omitempty"`
+	Published time.Time `json:"published,omitzero"`
+}
+
+func (ri *RepoIndex) find(name, ver string) *IndexVersion {
+	pkg, ok := ri.Packages[name]
+	if !ok {
+		return nil
+	}
+	for i := range pkg.Versions {
+		if pkg.Versions[i].Ver == ver {
+			return &pkg.Versions[i]
+		}
+	}
+	return nil
+}
+
+// add or replace the version of the package, versions are kept sorted
+func (ri *RepoIndex) add(name string, v IndexVersion) {
+	if ri.Packages == nil {
+		ri.Packages = make(map[string]*IndexPackage)
+	}
+	pkg, ok := ri.Packages[name]
+	if !ok {
+		pkg = &IndexPackage{}
+		ri.Packages[name] = pkg
+	}
+	pkg.Versions = slices.DeleteFunc(pkg.Versions, func(iv IndexVersion) bool {
+		return iv.Ver == v.Ver
+	})
+	pkg.Versions = append(pkg.Versions, v)
+	slices.SortFunc(pkg.Versions, func(a, b IndexVersion) int {
+		return compareVersions(a.Ver, b.Ver)
+	})
+}
+
+// remove the version of the package, returns false if the index has no such version
+func (ri *RepoIndex) remove(name, ver string) bool {
+	pkg, ok := ri.Packages[name]
+	if !ok || ri.find(name, ver) == nil {
+		return false
+	}
+	pkg.Versions = slices.DeleteFunc(pkg.Versions, func(iv IndexVersion) bool {
+		return iv.Ver == ver
+	})
+	if len(pkg.Versions) == 0 {
+		delete(ri.Packages, name)
+	}
+	return true
+}
+
+// readIndex downloads index of the repository, returns nil if the repository has no index
+func readIndex(ctx context.Context, repo Repository) (*RepoIndex, error) {
+	if _, err := repo.Stat(ctx, indexFileName); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to stat repository index: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := repo.Fetch(ctx, indexFileName, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download repository index: %w", err)
+	}
+	var index RepoIndex
+	if err := json.Unmarshal(buf.Bytes(), &index); err != nil {
+		return nil, fmt.Errorf("failed to parse repository index: %w", err)
+	}
+	return &index, nil
+}
+
+// publishToIndex adds the archive version to the repository index
+func publishToIndex(ctx context.Context, repo Repository, name string, v IndexVersion) error {
+	return updateIndex(ctx, repo, func(index *RepoIndex) bool {
+		index.add(name, v)
+		return true
+	})
+}
+
+// unpublishFromIndex removes the version from the repository index, the index is not written
+// if it has no such version
+func unpublishFromIndex(ctx context.Context, repo Repository, name, ver string) error {
+	return updateIndex(ctx, repo, func(index *RepoIndex) bool {
+		return index.remove(name, ver)
+	})
+}
+
+// updateIndex changes the repository index, it is written if change returns true.
+// Upload replaces index.json atomically, readers never see a partial file.
+// The index is locked, so versions published at the same time are not lost.
+func updateIndex(ctx context.Context, repo Repository, change func(*RepoIndex) bool) error {
+	unlock, err := lockIndex(ctx, repo)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := readIndex(ctx, repo)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		index = &RepoIndex{}
+	}
+	if !change(index) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository index: %w", err)
+	}
+	if err := repo.Upload(ctx, indexFileName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to upload repository index: %w", err)
+	}
+	return nil
+}
+
+// lockIndex waits for the index lock, the returned func releases it
+func lockIndex(ctx context.Context, repo Repository) (func(), error) {
+	locked := func(err error) error {
+		return fmt.Errorf("repository index is locked by another publisher, remove %s if none is running: %w", indexLockName, err)
+	}
+	deadline := time.Now().Add(indexLockTimeout)
+	for {
+		err := repo.Lock(ctx, indexLockName)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("failed to lock repository index: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return nil, locked(err)
+		}
+		// the wait also ends with the context of the command
+		select {
+		case <-ctx.Done():
+			return nil, locked(ctx.Err())
+		case <-time.After(indexLockRetry):
+		}
+	}
+
+	return func() {
+		// the lock is released even if the context is done meanwhile
+		if err := repo.Delete(context.WithoutCancel(ctx), indexLockName); err != nil {
+			slog.Warn("Failed to unlock repository index", "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,216 @@
+package pacm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// SearchResult is a package of the repository which name matches the pattern
+type SearchResult struct {
+	Name   string
+	Latest string // latest stable version, latest pre-release if the package has no stable ones
+}
+
+// SearchPackages lists packages of the repository by name: pattern with *, ? or [ is matched
+// as a glob, other patterns as a substring
+func (pm *PackageManager) SearchPackages(ctx context.Context, pattern string) ([]SearchResult, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	src := newRepoSource(pm.repo)
+	names, err := src.packages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []SearchResult
+	for _, name := range names {
+		if !matchName(pattern, name) {
+			continue
+		}
+		versions, err := src.versions(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		res = append(res, SearchResult{Name: name, Latest: latestVersion(versions)})
+	}
+	return res, nil
+}
+
+func matchName(pattern, name string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	return strings.Contains(name, pattern)
+}
+
+// highest stable version, highest pre-release if there are no stable versions
+func latestVersion(versions []string) string {
+	versions = slices.SortedFunc(slices.Values(versions), compareVersions)
+	for _, ver := range slices.Backward(versions) {
+		if checkVersion("", ver) {
+			return ver
+		}
+	}
+	return versions[len(versions)-1]
+}
+
+// parsePacketSpec parses name[@constraint] given in the command line
+func parsePacketSpec(spec string) (Packet, error) {
+	name, constraint, _ := strings.Cut(spec, "@")
+	p := Packet{Name: name, Ver: constraint}
+	return p, validatePacket(p)
+}
+
+// PackageInfo describes available versions of the package
+type PackageInfo struct {
+	Name       string
+	Constraint string
+	Versions   []IndexVersion // oldest first
+	Selected   *IndexVersion  // version the constraint resolves to, nil if none matches
+	Manifest   *Manifest      // manifest of the selected version
+}
+
+// Info shows versions of the package by spec name[@constraint] and the version the constraint
+// resolves to. Manifest of the selected version is read from its archive.
+func (pm *PackageManager) Info(ctx context.Context, spec string) (*PackageInfo, error) {
+	pkg, err := parsePacketSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	name, constraint := pkg.Name, pkg.Ver
+
+	src := newRepoSource(pm.repo)
+	versions, err := src.versions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("package %s is not found in the repository", name)
+	}
+	slices.SortFunc(versions, compareVersions)
+
+	info := &PackageInfo{Name: name, Constraint: constraint}
+	for _, ver := range versions {
+		v, err := src.version(ctx, name, ver)
+		if err != nil {
+			return nil, err
+		}
+		info.Versions = append(info.Versions, *v)
+	}
+	for i := range slices.Backward(info.Versions) {
+		if checkVersion(constraint, info.Versions[i].Ver) {
+			info.Selected = &info.Versions[i]
+			break
+		}
+	}
+	if info.Selected == nil {
+		return info, nil
+	}
+
+	dir, err := os.MkdirTemp("", "pacman-info-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ver := info.Selected.Ver
+	archiveName := filepath.Join(dir, archiveFileName(name, ver))
+	if err := downloadArchive(ctx, pm.repo, name, ver, archiveName); err != nil {
+		return nil, err
+	}
+	if err := src.verify(ctx, name, ver, archiveName); err != nil {
+		return nil, err
+	}
+	if info.Manifest, err = readManifest(archiveName, name, ver); err != nil {
+		return nil, err
+	}
+	info.Selected.Packets = info.Manifest.Packets
+	return info, nil
+}
+
+// Print writes the package info in human readable form
+func (info *PackageInfo) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
+	if info.Constraint != "" {
+		fmt.Fprintf(tw, "Constraint:\t%s\n", info.Constraint)
+	}
+	if sel := info.Selected; sel == nil {
+		fmt.Fprintln(tw, "Version:\tno version matches")
+	} else {
+		fmt.Fprintf(tw, "Version:\t%s\n", sel.Ver)
+		fmt.Fprintf(tw, "Size:\t%d\n", sel.Size)
+		fmt.Fprintf(tw, "Published:\t%s\n", formatTime(sel.Published))
+		deps := make([]string, 0, len(sel.Packets))
+		for _, p := range sel.Packets {
+			deps = append(deps, strings.TrimSpace(p.Name+" "+p.Ver))
+		}
+		fmt.Fprintf(tw, "Depends:\t%s\n", strings.Join(deps, ", "))
+		if m := info.Manifest; m != nil && !m.Created.IsZero() {
+			fmt.Fprintf(tw, "Created:\t%s by %s, %s\n", formatTime(m.Created), m.Creator, m.Tool)
+			fmt.Fprintf(tw, "Files:\t%d\n", len(m.Files))
+		}
+	}
+
+	fmt.Fprintln(tw, "Versions:")
+	for _, v := range info.Versions {
+		mark := " "
+		if info.Selected != nil && v.Ver == info.Selected.Ver {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s %s\t%d\t%s\n", mark, v.Ver, v.Size, formatTime(v.Published))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// package names from the repository index, directories of the repository without index
+func (src *repoSource) packages(ctx context.Context) ([]string, error) {
+	if index := src.getIndex(ctx); index != nil {
+		return slices.Sorted(maps.Keys(index.Packages)), nil
+	}
+	names, err := src.repo.Packages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// other directories of the repository root are not packages
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return validatePackageName(name) != nil
+	})
+	slices.Sort(names)
+	return names, nil
+}
+
+// version of the package from the index, size and mtime of the archive without index
+func (src *repoSource) version(ctx context.Context, name, ver string) (*IndexVersion, error) {
+	if index := src.getIndex(ctx); index != nil {
+		if v := index.find(name, ver); v != nil {
+			return v, nil
+		}
+	}
+	fi, err := src.repo.Stat(ctx, archivePath(name, ver))
+	if err != nil {
+		return nil, err
+	}
+	return &IndexVersion{Ver: ver, Archive: archivePath(name, ver), Size: fi.Size(), Published: fi.ModTime()}, nil
+}
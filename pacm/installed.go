@@ -0,0 +1,236 @@
+package pacm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// database of installed packages, PACMAN_DB overrides the path.
+// Users who can't write it get a per-user database, see systemOrUserPath.
+const defaultInstalledDB = "/var/lib/pacman/installed.json"
+
+// InstalledDB records packages installed by pm update
+type InstalledDB struct {
+	Packages []InstalledPackage `json:"packages"`
+}
+
+type InstalledPackage struct {
+	Name      string          `json:"name"`
+	Ver       string          `json:"ver"`
+	Root      string          `json:"root"` // absolute install dir of the package
+	Archive   string          `json:"archive,omitempty"`
+	SHA256    string          `json:"sha256,omitempty"` // checksum of the installed archive
+	Packets   []Packet        `json:"packets,omitempty"`
+	Explicit  bool            `json:"explicit"` // listed in packages config, not only a dependency
+	Files     []InstalledFile `json:"files"`
+	Installed time.Time       `json:"installed"`
+
+	Generations []PackageGeneration `json:"generations,omitempty"` // previous versions, newest first
+}
+
+// PackageGeneration is a previously installed version which archive is kept in the cache
+type PackageGeneration struct {
+	Ver       string    `json:"ver"`
+	Archive   string    `json:"archive"`
+	SHA256    string    `json:"sha256"`
+	Packets   []Packet  `json:"packets,omitempty"`
+	Installed time.Time `json:"installed"`
+}
+
+// InstalledFile is an unpacked archive entry, path is relative to the install dir
+type InstalledFile struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"` // file, dir, symlink or hardlink
+	Mode   os.FileMode `json:"mode,omitempty"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+}
+
+const (
+	fileTypeRegular  = "file"
+	fileTypeDir      = "dir"
+	fileTypeSymlink  = "symlink"
+	fileTypeHardlink = "hardlink"
+)
+
+func installedDBPath() string {
+	if p := os.Getenv("PACMAN_DB"); p != "" {
+		return p
+	}
+	return systemOrUserPath(defaultInstalledDB)
+}
+
+// systemOrUserPath returns the system path if it can be written, so non-root users keep their
+// packages in $XDG_STATE_HOME/pacman (~/.local/state/pacman) under the same file name
+func systemOrUserPath(system string) string {
+	if canWrite(filepath.Dir(system)) {
+		return system
+	}
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return system
+		}
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+	p := filepath.Join(stateDir, "pacman", filepath.Base(system))
+	slog.Debug("System path is not writable, per-user path is used", "system", system, "path", p)
+	return p
+}
+
+// canWrite checks that files can be created in dir, missing dirs are checked by their nearest parent.
+// Nothing is written, read-only commands also choose the path.
+func canWrite(dir string) bool {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			return info.IsDir() && dirWritable(dir)
+		}
+		if !errors.Is(err, os.ErrNotExist) || filepath.Dir(dir) == dir {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// readInstalledDB returns empty database if the file does not exist yet
+func readInstalledDB(path string) (*InstalledDB, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &InstalledDB{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read installed packages: %w", err)
+	}
+	var db InstalledDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("failed to parse installed packages %s: %w", path, err)
+	}
+	return &db, nil
+}
+
+// write replaces the database file atomically
+func (db *InstalledDB) write(path string) error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal installed packages: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create database dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write installed packages: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write installed packages: %w", err)
+	}
+	return nil
+}
+
+func (db *InstalledDB) find(name string) *InstalledPackage {
+	for i := range db.Packages {
+		if db.Packages[i].Name == name {
+			return &db.Packages[i]
+		}
+	}
+	return nil
+}
+
+// upToDate reports if the package of the version is installed to dir,
+// in locked mode the installed archive must match the lockfile
+func (p *InstalledPackage) upToDate(ver, dir string, lock *Lockfile) bool {
+	if p == nil || p.Ver != ver || p.Root != dir || p.SHA256 == "" {
+		return false
+	}
+	if lock != nil {
+		if lp := lock.find(p.Name); lp == nil || lp.SHA256 != p.SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// generation finds the kept version, the latest one if ver is empty
+func (p *InstalledPackage) generation(ver string) *PackageGeneration {
+	for i := range p.Generations {
+		if ver == "" || p.Generations[i].Ver == ver {
+			return &p.Generations[i]
+		}
+	}
+	return nil
+}
+
+// upgrade replaces the installed package, the replaced version becomes the latest generation
+// and at most keep generations are kept
+func (db *InstalledDB) upgrade(pkg InstalledPackage, keep int) {
+	if old := db.find(pkg.Name); old != nil {
+		gens := slices.Clone(old.Generations)
+		if old.Ver != pkg.Ver && old.SHA256 != "" {
+			gens = slices.Insert(gens, 0, PackageGeneration{
+				Ver:       old.Ver,
+				Archive:   old.Archive,
+				SHA256:    old.SHA256,
+				Packets:   old.Packets,
+				Installed: old.Installed,
+			})
+		}
+		gens = slices.DeleteFunc(gens, func(g PackageGeneration) bool {
+			return g.Ver == pkg.Ver
+		})
+		if len(gens) > keep {
+			gens = gens[:keep]
+		}
+		pkg.Generations = gens
+	}
+	db.set(pkg)
+}
+
+// set adds or replaces the package, packages are kept sorted by name
+func (db *InstalledDB) set(pkg InstalledPackage) {
+	db.remove(pkg.Name)
+	db.Packages = append(db.Packages, pkg)
+	slices.SortFunc(db.Packages, func(a, b InstalledPackage) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+func (db *InstalledDB) remove(name string) {
+	db.Packages = slices.DeleteFunc(db.Packages, func(p InstalledPackage) bool {
+		return p.Name == name
+	})
+}
+
+// ListPackages prints installed packages, with files if files is set
+func ListPackages(w io.Writer, dbPath string, files bool) error {
+	db, err := readInstalledDB(dbPath)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tROOT\tINSTALLED")
+	for _, pkg := range db.Packages {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", pkg.Name, pkg.Ver, pkg.Root, pkg.Installed.Local().Format(time.DateTime))
+		if !files {
+			continue
+		}
+		for _, f := range pkg.Files {
+			if f.Type != fileTypeDir {
+				fmt.Fprintf(tw, "  %s\n", filepath.Join(pkg.Root, filepath.FromSlash(f.Path)))
+			}
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,103 @@
+package pacm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const lockfileName = "packages.lock"
+
+// Lockfile records exact versions of all installed packages including dependencies
+type Lockfile struct {
+	Packages []LockedPacket `json:"packages"`
+}
+
+type LockedPacket struct {
+	Name    string `json:"name"`
+	Ver     string `json:"ver"`
+	Archive string `json:"archive"`
+	SHA256  string `json:"sha256"`
+}
+
+// lockfile is stored next to the packages config
+func lockfilePath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), lockfileName)
+}
+
+func readLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile %s: %w", path, err)
+	}
+	for _, lp := range lock.Packages {
+		if err := validatePackageName(lp.Name); err != nil {
+			return nil, fmt.Errorf("lockfile %s: %w", path, err)
+		}
+		if _, err := parseVersion(lp.Ver); err != nil {
+			return nil, fmt.Errorf("lockfile %s: package %s: %w", path, lp.Name, err)
+		}
+	}
+	return &lock, nil
+}
+
+func (l *Lockfile) write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	return nil
+}
+
+func (l *Lockfile) find(name string) *LockedPacket {
+	for i := range l.Packages {
+		if l.Packages[i].Name == name {
+			return &l.Packages[i]
+		}
+	}
+	return nil
+}
+
+// check that locked versions satisfy the packages config, pre-releases match ranges only with prerelease
+func (l *Lockfile) check(config PackagesConfig, prerelease bool) error {
+	for _, pkg := range config.Packages {
+		lp := l.find(pkg.Name)
+		if lp == nil {
+			return fmt.Errorf("package %s is not locked", pkg.Name)
+		}
+		if !matchVersion(pkg.Ver, lp.Ver, prerelease) {
+			return fmt.Errorf("locked version %s of %s does not satisfy %q", lp.Ver, pkg.Name, pkg.Ver)
+		}
+	}
+	return nil
+}
+
+// packets to install in lockfile order, every locked version must still exist on the server
+func (l *Lockfile) packets(ctx context.Context, src packetSource) ([]*resolvedPacket, error) {
+	res := make([]*resolvedPacket, 0, len(l.Packages))
+	for _, lp := range l.Packages {
+		vers, err := src.versions(ctx, lp.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get versions of %s: %w", lp.Name, err)
+		}
+		if !slices.Contains(vers, lp.Ver) {
+			return nil, fmt.Errorf("locked package %s %s is not found on the server", lp.Name, lp.Ver)
+		}
+		deps, err := src.packets(ctx, lp.Name, lp.Ver)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get dependencies of %s: %w", lp.Name, err)
+		}
+		res = append(res, &resolvedPacket{Name: lp.Name, Ver: lp.Ver, Packets: deps})
+	}
+	return res, nil
+}
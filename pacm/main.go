@@ -7,12 +7,12 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli/v2"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/term"
 )
 
 type PackageConfig struct {
@@ -23,8 +23,10 @@ type PackageConfig struct {
 }
 
 type Target struct {
-	Path    string `json:"path" yaml:"path"`
-	Exclude string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	Path        string `json:"path" yaml:"path"`
+	Exclude     string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	Dest        string `json:"dest,omitempty" yaml:"dest,omitempty"`                 // dir of matched files inside the package
+	StripPrefix string `json:"strip_prefix,omitempty" yaml:"strip_prefix,omitempty"` // removed from file paths, default dir of path if dest is set
 }
 
 // custom unmarshall prepare string and struct types of target
@@ -49,6 +51,7 @@ func (t *Target) UnmarshalJSON(data []byte) error {
 type Packet struct {
 	Name string `json:"name" yaml:"name"`
 	Ver  string `json:"ver" yaml:"ver"`
+	Dest string `json:"dest,omitempty" yaml:"dest,omitempty"` // install dir of the package, relative to the prefix
 }
 
 type PackagesConfig struct {
@@ -56,55 +59,23 @@ type PackagesConfig struct {
 }
 
 type PackageManager struct {
-	sshConfig *ssh.ClientConfig
-	server    string
+	repo        Repository
+	db          string // path of installed packages database
+	cache       string // dir of archives of installed and previous versions
+	generations int    // number of previous versions kept for rollback
 }
 
-func NewPackageManager(server, user, keyPath string) (*PackageManager, error) {
-	key, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read SSH key: %v", err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		if _, ok := err.(*ssh.PassphraseMissingError); ok {
-			// missing passphrase for protected SSH key
-			var passphrase []byte
-			pass, ok := os.LookupEnv("PACMAN_SSH_KEY_PASS")
-
-			if !ok {
-				fmt.Print("Enter passphrase for SSH key: ")
-				passphrase, err = term.ReadPassword(int(os.Stdin.Fd()))
-				if err != nil {
-					return nil, fmt.Errorf("failed to read passphrase: %v", err)
-				}
-
-				fmt.Println()
-			} else {
-				passphrase = []byte(pass)
-			}
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse SSH key with passphrase: %v", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to parse SSH key: %v", err)
-		}
-	}
-
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+func NewPackageManager(repo Repository) *PackageManager {
+	return &PackageManager{
+		repo:        repo,
+		db:          installedDBPath(),
+		cache:       cacheDirPath(),
+		generations: keptGenerations(),
 	}
+}
 
-	return &PackageManager{
-		sshConfig: config,
-		server:    server,
-	}, nil
+func (pm *PackageManager) Close() error {
+	return pm.repo.Close()
 }
 
 func Main() {
@@ -112,22 +83,14 @@ func Main() {
 	if err != nil {
 		fmt.Printf("file .env don't load: %v\n", err)
 	}
-	host, ok := os.LookupEnv("PACMAN_SSH_HOST")
-	if !ok {
-		host = "localhost"
-	}
-	port, ok := os.LookupEnv("PACMAN_SSH_PORT")
-	if !ok {
-		port = "22"
-	}
-	user := os.Getenv("PACMAN_SSH_USER")
-	keyPath := os.Getenv("PACMAN_SSH_KEY")
-	server := fmt.Sprintf("%s:%s", host, port)
 
-	pm, err := NewPackageManager(server, user, keyPath)
-	if err != nil {
-		fmt.Printf("Failed to initialize package manager: %v\n", err)
-		os.Exit(1)
+	// repository is opened by commands that need it
+	openPM := func() (*PackageManager, error) {
+		repo, err := OpenRepository(os.Getenv("PACMAN_REPO"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize package manager: %w", err)
+		}
+		return NewPackageManager(repo), nil
 	}
 
 	if logLevel, ok := os.LookupEnv("PACMAN_LOG"); ok && logLevel == "debug" {
@@ -135,6 +98,8 @@ func Main() {
 	}
 
 	TIMEOUT := 3 * time.Second
+	// publishing may wait for other publishers to release the repository index
+	PUBLISH_TIMEOUT := TIMEOUT + indexLockTimeout
 
 	app := &cli.App{
 		Name: "pm",
@@ -143,26 +108,321 @@ func Main() {
 				Name:      "create",
 				Usage:     "Create and upload a package",
 				ArgsUsage: "[config-file.json(yaml)]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "sign-key",
+						Usage:   "private SSH key to sign the package (default PACMAN_SSH_KEY)",
+						EnvVars: []string{"PACMAN_SIGN_KEY"},
+					},
+					&cli.BoolFlag{
+						Name:  "no-sign",
+						Usage: "do not sign the package",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "list files of the package and the archive name, nothing is created or uploaded",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("config file path is required")
+					}
+					if c.Bool("dry-run") {
+						plan, err := PlanPackage(c.Context, c.Args().First())
+						if err != nil {
+							return err
+						}
+						plan.Print(os.Stdout)
+						return nil
+					}
+					// key is loaded before timeout starts, passphrase may be asked
+					var opts CreateOptions
+					keyPath := c.String("sign-key")
+					if keyPath == "" {
+						keyPath = os.Getenv("PACMAN_SSH_KEY")
+					}
+					if keyPath != "" && !c.Bool("no-sign") {
+						signer, err := loadSSHSigner(keyPath)
+						if err != nil {
+							return fmt.Errorf("failed to load signing key: %w", err)
+						}
+						opts.Signer = signer
+					}
+
+					ctx, cancel := context.WithTimeout(c.Context, PUBLISH_TIMEOUT)
+					defer cancel()
+					pm, err := openPM()
+					if err != nil {
+						return err
+					}
+					defer pm.Close()
+					return pm.CreatePackage(ctx, c.Args().First(), opts)
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List installed packages",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "files",
+						Usage: "list installed files of packages",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return ListPackages(os.Stdout, installedDBPath(), c.Bool("files"))
+				},
+			},
+			{
+				Name:      "remove",
+				Usage:     "Remove installed packages",
+				ArgsUsage: "<name>...",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "cascade",
+						Usage: "also remove dependencies which are not needed by other packages",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("package name is required")
+					}
+					opts := RemoveOptions{Cascade: c.Bool("cascade")}
+					return RemovePackages(installedDBPath(), c.Args().Slice(), opts)
+				},
+			},
+			{
+				Name:      "rollback",
+				Usage:     "Restore previous version of installed package from the local cache",
+				ArgsUsage: "<name>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "version to restore (default previous version)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("package name is required")
+					}
+					opts := RollbackOptions{
+						To:          c.String("to"),
+						Generations: keptGenerations(),
+					}
+					return RollbackPackage(installedDBPath(), cacheDirPath(), c.Args().First(), opts)
+				},
+			},
+			{
+				Name:      "verify",
+				Usage:     "Check installed files, exit code 1 if files are missing, modified or unexpected",
+				ArgsUsage: "[name...]",
+				Action: func(c *cli.Context) error {
+					issues, err := VerifyPackages(installedDBPath(), c.Args().Slice())
+					if err != nil {
+						return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+					}
+					for _, issue := range issues {
+						fmt.Printf("%-10s %s %s\n", issue.Problem, issue.Package, issue.Path)
+					}
+					if len(issues) > 0 {
+						return cli.Exit("", 1)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "search",
+				Usage:     "Find packages in the repository, pattern is a glob or a part of the name",
+				ArgsUsage: "<pattern>",
 				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("search pattern is required")
+					}
 					ctx, cancel := context.WithTimeout(c.Context, TIMEOUT)
 					defer cancel()
+					pm, err := openPM()
+					if err != nil {
+						return err
+					}
+					defer pm.Close()
+					found, err := pm.SearchPackages(ctx, c.Args().First())
+					if err != nil {
+						return err
+					}
+					for _, r := range found {
+						fmt.Printf("%s %s\n", r.Name, r.Latest)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "info",
+				Usage:     "Show versions of the package in the repository and the version the constraint resolves to",
+				ArgsUsage: "<name>[@constraint]",
+				Action: func(c *cli.Context) error {
 					if c.NArg() != 1 {
-						return fmt.Errorf("config file path is required")
+						return fmt.Errorf("package name is required")
+					}
+					ctx, cancel := context.WithTimeout(c.Context, TIMEOUT)
+					defer cancel()
+					pm, err := openPM()
+					if err != nil {
+						return err
+					}
+					defer pm.Close()
+					info, err := pm.Info(ctx, c.Args().First())
+					if err != nil {
+						return err
 					}
-					return pm.CreatePackage(ctx, c.Args().First())
+					return info.Print(os.Stdout)
+				},
+			},
+			{
+				Name:      "deps",
+				Usage:     "Show resolved dependency tree of the packages config or of a package",
+				ArgsUsage: "<config-file.json(yaml)|name[@constraint]>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "pre",
+						Usage: "allow pre-release versions to match version ranges",
+					},
+					&cli.StringFlag{
+						Name:  "reverse",
+						Usage: "show what depends on the package",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "tree",
+						Usage: "output format: tree or dot (Graphviz)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("config file path or package name is required")
+					}
+					opts := DepsOptions{
+						Prerelease: c.Bool("pre"),
+						Reverse:    c.String("reverse"),
+						Format:     c.String("format"),
+					}
+					ctx, cancel := context.WithTimeout(c.Context, TIMEOUT)
+					defer cancel()
+					pm, err := openPM()
+					if err != nil {
+						return err
+					}
+					defer pm.Close()
+					graph, err := pm.Deps(ctx, c.Args().First(), opts)
+					if err != nil {
+						return err
+					}
+					return graph.Print(os.Stdout, opts)
 				},
 			},
 			{
 				Name:      "update",
 				Usage:     "Download and unpack packages",
 				ArgsUsage: "[config-file.json(yaml)]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "pre",
+						Usage: "allow pre-release versions to match version ranges",
+					},
+					&cli.BoolFlag{
+						Name:  "locked",
+						Usage: "install exactly the versions from packages.lock",
+					},
+					&cli.StringFlag{
+						Name:    "trusted-keys",
+						Usage:   "file with public keys of trusted publishers in authorized_keys format",
+						EnvVars: []string{"PACMAN_TRUSTED_KEYS"},
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "reinstall packages which are up to date",
+					},
+					&cli.StringFlag{
+						Name:    "prefix",
+						Usage:   "install root of packages (default current directory)",
+						EnvVars: []string{"PACMAN_INSTALL_ROOT"},
+					},
+					&cli.Int64Flag{
+						Name:    "max-size",
+						Usage:   "limit of unpacked size of one archive in bytes (default 1 GiB)",
+						EnvVars: []string{"PACMAN_MAX_UNPACK_SIZE"},
+					},
+					&cli.BoolFlag{
+						Name:  "same-owner",
+						Usage: "restore owner of files from the archive (root only)",
+					},
+					&cli.BoolFlag{
+						Name:    "require-signature",
+						Usage:   "refuse unsigned packages and packages signed by untrusted keys",
+						EnvVars: []string{"PACMAN_REQUIRE_SIGNATURE"},
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print versions to download and files to add, change or remove without installing",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					ctx, cancel := context.WithTimeout(c.Context, TIMEOUT)
 					defer cancel()
 					if c.NArg() != 1 {
 						return fmt.Errorf("config file path is required")
 					}
-					return pm.UpdatePackages(ctx, c.Args().First())
+					opts := UpdateOptions{
+						Prerelease: c.Bool("pre"),
+						Locked:     c.Bool("locked"),
+						Prefix:     c.String("prefix"),
+						Force:      c.Bool("force"),
+						Signature:  SignaturePolicy{Require: c.Bool("require-signature")},
+						MaxSize:    c.Int64("max-size"),
+						SameOwner:  c.Bool("same-owner"),
+					}
+					if keysPath := c.String("trusted-keys"); keysPath != "" {
+						keys, err := LoadTrustedKeys(keysPath)
+						if err != nil {
+							return err
+						}
+						opts.Signature.TrustedKeys = keys
+					}
+					pm, err := openPM()
+					if err != nil {
+						return err
+					}
+					defer pm.Close()
+					if c.Bool("dry-run") {
+						plan, err := pm.PlanUpdate(ctx, c.Args().First(), opts)
+						if err != nil {
+							return err
+						}
+						return plan.Print(os.Stdout)
+					}
+					return pm.UpdatePackages(ctx, c.Args().First(), opts)
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve the repository directory PACMAN_ROOT_DIR over HTTP",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "addr",
+						Value: ":8080",
+						Usage: "address to listen on",
+					},
+					&cli.StringFlag{
+						Name:    "root",
+						Usage:   "repository directory",
+						EnvVars: []string{"PACMAN_ROOT_DIR"},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.String("root") == "" {
+						return fmt.Errorf("repository directory is required")
+					}
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					return Serve(ctx, c.String("addr"), c.String("root"))
 				},
 			},
 		},
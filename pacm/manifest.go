@@ -0,0 +1,211 @@
+package pacm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ToolVersion is written to manifests of created packages, it is set at build time:
+// go build -ldflags "-X package_mgr/pacm.ToolVersion=1.2.0"
+var ToolVersion = "dev"
+
+// manifest is the last entry of the archive, files under .pacman/ are not installed
+const (
+	manifestDir  = ".pacman"
+	manifestPath = manifestDir + "/manifest.json"
+
+	maxManifestSize = 16 << 20
+)
+
+// Manifest describes the package and every file of its archive
+type Manifest struct {
+	Name    string         `json:"name"`
+	Ver     string         `json:"ver"`
+	Packets []Packet       `json:"packets,omitempty"`
+	Created time.Time      `json:"created"`
+	Creator string         `json:"creator,omitempty"` // user@host
+	Tool    string         `json:"tool"`
+	Files   []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Path   string      `json:"path"`
+	Type   string      `json:"type"` // file, dir, symlink or hardlink
+	Size   int64       `json:"size,omitempty"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+}
+
+func newManifest(config *PackageConfig) *Manifest {
+	m := &Manifest{
+		Name:    config.Name,
+		Ver:     config.Ver,
+		Packets: config.Packets,
+		Created: time.Now().UTC(),
+		Tool:    "pm " + ToolVersion,
+	}
+	if u, err := user.Current(); err == nil {
+		m.Creator = u.Username
+		if host, err := os.Hostname(); err == nil {
+			m.Creator += "@" + host
+		}
+	}
+	return m
+}
+
+// check unpacked files against the manifest
+func (m *Manifest) check(files []InstalledFile) error {
+	listed := make(map[string]string) // path -> sha256 of regular files
+	for _, mf := range m.Files {
+		if mf.Type == fileTypeRegular {
+			listed[mf.Path] = mf.SHA256
+		}
+	}
+	for _, f := range files {
+		if f.Type != fileTypeRegular {
+			continue
+		}
+		sum, ok := listed[f.Path]
+		if !ok {
+			return fmt.Errorf("file %s is not listed in the package manifest", f.Path)
+		}
+		if sum != f.SHA256 {
+			return &ChecksumError{Path: f.Path, Want: sum, Got: f.SHA256}
+		}
+		delete(listed, f.Path)
+	}
+	for p := range listed {
+		return fmt.Errorf("file %s of the package manifest is missing in the archive", p)
+	}
+	return nil
+}
+
+// write manifest as the last entry of the archive
+func (m *Manifest) writeTo(tw *tar.Writer) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	header := &tar.Header{
+		Name:     manifestPath,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  m.Created,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write manifest header: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// entries under .pacman/ describe the package and are not installed
+func isManifestEntry(name string) bool {
+	first, _, _ := strings.Cut(path.Clean(name), "/")
+	return first == manifestDir
+}
+
+func parseManifest(r io.Reader) (*Manifest, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// readManifest reads manifest of the package from the archive.
+// Archives created before manifests have meta-<name>-<ver>.json with a copy of the package config,
+// archives without both have no dependencies.
+func readManifest(archivePath, packName, ver string) (*Manifest, error) {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archiveFile.Close()
+
+	gr, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gr.Close()
+
+	var meta *Manifest
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar: %w", err)
+		}
+
+		m, legacy, err := parseManifestEntry(header, tr, packName, ver)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %w", archivePath, err)
+		}
+		if m != nil && !legacy {
+			return m, nil
+		}
+		if m != nil {
+			meta = m
+		}
+	}
+
+	if meta == nil {
+		slog.Debug("manifest not found in archive", "archive", archivePath)
+		meta = &Manifest{Name: packName, Ver: ver}
+	}
+	return meta, nil
+}
+
+// parseManifestEntry parses the tar entry if it is the manifest or the legacy meta file of the package,
+// returns nil for other entries
+func parseManifestEntry(header *tar.Header, r io.Reader, packName, ver string) (m *Manifest, legacy bool, err error) {
+	metaName := fmt.Sprintf("meta-%s-%s.json", packName, ver)
+
+	switch {
+	case path.Clean(header.Name) == manifestPath:
+		m, err := parseManifest(r)
+		if err != nil {
+			return nil, false, err
+		}
+		if m.Name != packName || m.Ver != ver {
+			return nil, false, fmt.Errorf("manifest of %s %s is found instead of %s %s", m.Name, m.Ver, packName, ver)
+		}
+		return m, false, nil
+	case path.Base(header.Name) == metaName:
+		metaData, err := io.ReadAll(io.LimitReader(r, maxManifestSize))
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to read meta file %s: %w", metaName, err)
+		}
+		// meta file is a copy of the package config, it may be yaml
+		var config PackageConfig
+		if err := json.Unmarshal(metaData, &config); err != nil {
+			if err := yaml.Unmarshal(metaData, &config); err != nil {
+				return nil, true, fmt.Errorf("failed to parse meta file %s: %w", metaName, err)
+			}
+		}
+		return &Manifest{Name: packName, Ver: ver, Packets: config.Packets}, true, nil
+	}
+	return nil, false, nil
+}
@@ -2,19 +2,33 @@ package pacm
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestGetArch(t *testing.T) {
 	slog.SetLogLoggerLevel(slog.LevelDebug)
+	chdirTemp(t)
 
 	packName, archiveName, err := getArch(context.Background(), "./testdata/p.json")
 
@@ -24,14 +38,59 @@ func TestGetArch(t *testing.T) {
 
 	expectedFilesInfo := make(map[string]int64, 5)
 	expectedFilesInfo["testdata/package/main.go"] = int64(70)
-	expectedFilesInfo["meta-packet-1-1.10.json"] = int64(186)
 	expectedFilesInfo["testdata/package1/packages.txt"] = int64(182)
 	expectedFilesInfo["testdata/package1/packet.txt"] = int64(241)
 
 	filesInfo := listTarGzContents(t, archiveName)
+	assert.Contains(t, filesInfo, manifestPath)
+	delete(filesInfo, manifestPath)
 	assert.Equal(t, expectedFilesInfo, filesInfo)
 }
 
+func TestGetArchTargetDest(t *testing.T) {
+	chdirTemp(t)
+	config := t.TempDir() + "/packet-5.yaml"
+	require.NoError(t, os.WriteFile(config, []byte(`name: packet-5
+ver: "1.0"
+targets:
+  - path: ./testdata/package1/*.txt
+    dest: doc/
+  - path: ./testdata/package/main.go
+    strip_prefix: ./testdata
+    dest: src
+`), 0644))
+
+	_, archiveName, err := getArch(context.Background(), config)
+	require.NoError(t, err)
+
+	files := listTarGzContents(t, archiveName)
+	assert.Contains(t, files, "doc/packet.txt")
+	assert.Contains(t, files, "doc/packages.txt")
+	assert.Contains(t, files, "src/package/main.go")
+	assert.Len(t, files, 4)
+
+	plan, err := PlanPackage(context.Background(), config)
+	require.NoError(t, err)
+	assert.Equal(t, "packet-5-1.0.tar.gz", plan.Archive)
+	require.Len(t, plan.Targets, 2)
+	assert.Equal(t, []PlannedFile{{Path: "testdata/package/main.go", Name: "src/package/main.go"}}, plan.Targets[1].Files)
+
+	assert.Error(t, (&Target{Path: "./testdata/package/main.go", Dest: "../bin"}).validate())
+	_, err = (&Target{Path: "./testdata/package/main.go", StripPrefix: "./build"}).entryName("testdata/package/main.go")
+	assert.Error(t, err)
+}
+
+// absolute path of testdata, tests change the working directory
+var testdataDir, _ = filepath.Abs("testdata")
+
+// chdirTemp makes a temp dir the working directory, so archives created by the test are not left
+// in the source tree. testdata is linked there by absolute path, configs refer to it relatively.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.Symlink(testdataDir, "testdata"))
+}
+
 // content list of  .tar.gz file
 func listTarGzContents(t *testing.T, archivePath string) map[string]int64 {
 	t.Helper()
@@ -205,12 +264,56 @@ func TestCheckVersion(t *testing.T) {
 			actualVer:   "",
 			want:        false,
 		},
-		// {
-		// 	name:        "invalid version format",
-		// 	requiredVer: ">1.12-beta",
-		// 	actualVer:   "1.13",
-		// 	want:        false,
-		// },
+		{
+			name:        "invalid version format",
+			requiredVer: ">1.12.beta",
+			actualVer:   "1.13",
+			want:        false,
+		},
+
+		// pre-release
+		{
+			name:        "pre-release operand",
+			requiredVer: ">1.12-beta",
+			actualVer:   "1.13",
+			want:        true,
+		},
+		{
+			name:        "pre-release lower than release",
+			requiredVer: "<1.2.0",
+			actualVer:   "1.2.0-rc1",
+			want:        false,
+		},
+		{
+			name:        "pre-release of the same release in range",
+			requiredVer: ">=1.2.0-rc1",
+			actualVer:   "1.2.0-rc2",
+			want:        true,
+		},
+		{
+			name:        "pre-release of other release excluded from range",
+			requiredVer: ">=1.2.0-rc1",
+			actualVer:   "1.3.0-rc1",
+			want:        false,
+		},
+		{
+			name:        "pre-release excluded without version",
+			requiredVer: "",
+			actualVer:   "1.3.0-rc1",
+			want:        false,
+		},
+		{
+			name:        "equal pre-release",
+			requiredVer: "1.3.0-rc.1",
+			actualVer:   "1.3.0-rc.1",
+			want:        true,
+		},
+		{
+			name:        "build metadata ignored",
+			requiredVer: "1.3.0+build.1",
+			actualVer:   "1.3+build.2",
+			want:        true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -222,3 +325,1263 @@ func TestCheckVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestReadManifest(t *testing.T) {
+	chdirTemp(t)
+	_, archiveName, err := getArch(context.Background(), "./testdata/packet-2.json")
+	require.NoError(t, err)
+
+	meta, err := readManifest(archiveName, "packet-2", "2.1")
+	require.NoError(t, err)
+	assert.Equal(t, []Packet{{Name: "packet-3", Ver: "<=2.0"}, {Name: "packet-1"}}, meta.Packets)
+	assert.Equal(t, "pm "+ToolVersion, meta.Tool)
+	assert.False(t, meta.Created.IsZero())
+	require.Len(t, meta.Files, 2)
+	for _, f := range meta.Files {
+		assert.Equal(t, fileTypeRegular, f.Type)
+		assert.Equal(t, mustSHA256(t, f.Path), f.SHA256, f.Path)
+	}
+
+	// manifest is not installed
+	root := t.TempDir()
+	require.NoError(t, extractTo(root, archiveName, 0))
+	assert.NoDirExists(t, filepath.Join(root, manifestDir))
+
+	// archive of other package version
+	_, err = readManifest(archiveName, "packet-2", "2.0")
+	assert.Error(t, err)
+
+	// legacy archive with a copy of the config
+	legacy := filepath.Join(t.TempDir(), "packet-2-2.0.tar.gz")
+	writeTarGz(t, legacy, [][2]string{{"meta-packet-2-2.0.json", `{"name":"packet-2","ver":"2.0","packets":[{"name":"packet-1"}]}`}})
+	meta, err = readManifest(legacy, "packet-2", "2.0")
+	require.NoError(t, err)
+	assert.Equal(t, []Packet{{Name: "packet-1"}}, meta.Packets)
+
+	// content which does not match the manifest is refused
+	tampered := filepath.Join(t.TempDir(), "packet-2-2.1.tar.gz")
+	writeTarGz(t, tampered, [][2]string{
+		{"doc/readme.txt", "changed"},
+		{manifestPath, `{"name":"packet-2","ver":"2.1","files":[{"path":"doc/readme.txt","type":"file","sha256":"00"}]}`},
+	})
+	var sumErr *ChecksumError
+	assert.ErrorAs(t, extractTo(t.TempDir(), tampered, 0), &sumErr)
+}
+
+// in-memory packet source: name -> version -> dependencies
+type fakeSource map[string]map[string][]Packet
+
+func (f fakeSource) versions(_ context.Context, name string) ([]string, error) {
+	var vers []string
+	for ver := range f[name] {
+		vers = append(vers, ver)
+	}
+	return vers, nil
+}
+
+func (f fakeSource) packets(_ context.Context, name, ver string) ([]Packet, error) {
+	return f[name][ver], nil
+}
+
+func TestSolverResolve(t *testing.T) {
+	src := fakeSource{
+		"packet-1": {
+			"1.9":  {{Name: "packet-3", Ver: "<=2.0"}},
+			"1.10": {{Name: "packet-3", Ver: ">=3.0"}},
+		},
+		"packet-2": {
+			"2.1": {{Name: "packet-3", Ver: "<=2.1"}, {Name: "packet-1"}},
+		},
+		"packet-3": {
+			"1.0": nil,
+			"2.0": nil,
+			"3.0": nil,
+		},
+	}
+
+	// packet-1 1.10 needs packet-3 3.0, which conflicts with packet-2, solver backtracks to 1.9
+	packets, err := newSolver(src).resolve(context.Background(), []Packet{{Name: "packet-1"}, {Name: "packet-2"}}, "packages.json")
+	require.NoError(t, err)
+
+	chosen := make([]string, 0, len(packets))
+	for _, p := range packets {
+		chosen = append(chosen, p.Name+"@"+p.Ver)
+	}
+	assert.Equal(t, []string{"packet-3@2.0", "packet-1@1.9", "packet-2@2.1"}, chosen)
+}
+
+func TestSolverConflict(t *testing.T) {
+	src := fakeSource{
+		"packet-1": {"1.10": {{Name: "packet-3", Ver: "<=2.0"}}},
+		"packet-2": {"2.1": {{Name: "packet-3", Ver: ">2.1"}}},
+		"packet-3": {"2.0": nil, "3.0": nil},
+	}
+
+	_, err := newSolver(src).resolve(context.Background(), []Packet{{Name: "packet-1"}, {Name: "packet-2"}}, "packages.json")
+	var ce *ConflictError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, "version conflict for packet-3: packet-1 1.10 requires packet-3 <=2.0, packet-2 2.1 requires packet-3 >2.1 (available: 2.0, 3.0)", err.Error())
+
+	_, err = newSolver(src).resolve(context.Background(), []Packet{{Name: "packet-4"}}, "packages.json")
+	assert.EqualError(t, err, "no archives of package packet-4 found (packages.json requires packet-4)")
+
+	src["packet-3"]["2.0"] = []Packet{{Name: "packet-1"}}
+	_, err = newSolver(src).resolve(context.Background(), []Packet{{Name: "packet-1"}}, "packages.json")
+	assert.EqualError(t, err, "dependency cycle: packet-1 -> packet-3 -> packet-1")
+}
+
+func TestCompareVersions(t *testing.T) {
+	// sorted by semver precedence
+	versions := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.2",
+		"1.10",
+		"1.10.1",
+	}
+	for i := 1; i < len(versions); i++ {
+		assert.Equal(t, -1, compareVersions(versions[i-1], versions[i]), "%s < %s", versions[i-1], versions[i])
+		assert.Equal(t, 1, compareVersions(versions[i], versions[i-1]), "%s > %s", versions[i], versions[i-1])
+	}
+
+	assert.Equal(t, 0, compareVersions("1.10", "1.10.0"))
+	assert.Equal(t, 0, compareVersions("1.0.0+build.1", "1.0.0+build.2"))
+	assert.Equal(t, -1, compareVersions("bad", "0.1"))
+
+	assert.True(t, matchVersion(">=1.2", "1.3.0-rc1", true))
+	assert.False(t, matchVersion(">=1.2", "1.3.0-rc1", false))
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		notMatch   []string
+	}{
+		{">=1.2, <2.0", []string{"1.2", "1.9.9"}, []string{"1.1", "2.0", "2.0.0-rc1"}},
+		{">= 1.2 < 2.0", []string{"1.5"}, []string{"2.1"}},
+		{"^1.4", []string{"1.4", "1.4.0", "1.99"}, []string{"1.3.9", "2.0.0", "2.0.0-rc1"}},
+		{"^0.4", []string{"0.4.1"}, []string{"0.5", "0.3"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.9"}, []string{"1.4.1", "1.5.0"}},
+		{"~1", []string{"1.0", "1.9"}, []string{"2.0"}},
+		{"1.x", []string{"1.0", "1.99.1"}, []string{"0.9", "2.0"}},
+		{"1.2.*", []string{"1.2.0", "1.2.7"}, []string{"1.3.0"}},
+		{"*", []string{"0.1", "10.0"}, []string{"1.0-rc1"}},
+		{"!=1.3", []string{"1.2", "1.4"}, []string{"1.3", "1.3.0"}},
+		{"^1.0 || ^3.0", []string{"1.1", "3.2"}, []string{"2.0"}},
+		{"<1.0 || >=1.5, !=1.6", []string{"0.9", "1.5", "1.7"}, []string{"1.2", "1.6"}},
+		{">=1.2.0-rc1", []string{"1.2.0-rc2", "1.3"}, []string{"1.3.0-rc1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			c, err := parseConstraint(tt.constraint)
+			require.NoError(t, err)
+			for _, ver := range tt.match {
+				v, err := parseVersion(ver)
+				require.NoError(t, err)
+				assert.True(t, c.Match(v, false), "%s should match %s", ver, tt.constraint)
+			}
+			for _, ver := range tt.notMatch {
+				v, err := parseVersion(ver)
+				require.NoError(t, err)
+				assert.False(t, c.Match(v, false), "%s should not match %s", ver, tt.constraint)
+			}
+		})
+	}
+
+	for _, bad := range []string{"=1.12", ">=", "1.x.2", ">=1.x", "^1.0 ||", "1.2-", ">1.12.beta", ","} {
+		_, err := parseConstraint(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	lockPath := lockfilePath(t.TempDir() + "/packages.json")
+
+	lock := &Lockfile{Packages: []LockedPacket{
+		{Name: "packet-3", Ver: "2.0", Archive: "packet-3-2.0.tar.gz", SHA256: "abc"},
+		{Name: "packet-1", Ver: "1.10", Archive: "packet-1-1.10.tar.gz", SHA256: "def"},
+	}}
+	require.NoError(t, lock.write(lockPath))
+
+	got, err := readLockfile(lockPath)
+	require.NoError(t, err)
+	assert.Equal(t, lock, got)
+
+	assert.NoError(t, got.check(PackagesConfig{Packages: []Packet{{Name: "packet-1", Ver: ">=1.10"}}}, false))
+	assert.EqualError(t, got.check(PackagesConfig{Packages: []Packet{{Name: "packet-1", Ver: ">1.10"}}}, false),
+		`locked version 1.10 of packet-1 does not satisfy ">1.10"`)
+	assert.EqualError(t, got.check(PackagesConfig{Packages: []Packet{{Name: "packet-2"}}}, false),
+		"package packet-2 is not locked")
+
+	src := fakeSource{
+		"packet-1": {"1.10": nil},
+		"packet-3": {"2.0": nil, "3.0": nil},
+	}
+	packets, err := got.packets(context.Background(), src)
+	require.NoError(t, err)
+	assert.Equal(t, []*resolvedPacket{{Name: "packet-3", Ver: "2.0"}, {Name: "packet-1", Ver: "1.10"}}, packets)
+
+	delete(src["packet-3"], "2.0")
+	_, err = got.packets(context.Background(), src)
+	assert.EqualError(t, err, "locked package packet-3 2.0 is not found on the server")
+}
+
+func TestLockedPrerelease(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("PACMAN_DB", t.TempDir()+"/installed.json")
+	t.Setenv("PACMAN_CACHE_DIR", t.TempDir())
+	pm := NewPackageManager(NewFileRepository(t.TempDir()))
+	defer pm.Close()
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	t.Chdir(t.TempDir())
+	for _, ver := range []string{"1.0.0", "1.1.0-rc.1"} {
+		config := "packet-3-" + ver + ".json"
+		require.NoError(t, os.WriteFile(config, []byte(`{"name": "packet-3", "ver": "`+ver+`", "targets": [{"path": "`+wd+`/testdata/package/main.go", "dest": "lib"}]}`), 0644))
+		require.NoError(t, pm.CreatePackage(ctx, config, CreateOptions{}))
+	}
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-3", "ver": ">=1.0"}]}`), 0644))
+
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Prerelease: true}))
+	lock, err := readLockfile("packages.lock")
+	require.NoError(t, err)
+	require.Len(t, lock.Packages, 1)
+	assert.Equal(t, "1.1.0-rc.1", lock.Packages[0].Ver)
+
+	// locked pre-release is installed again with --pre and refused without it
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Locked: true, Prerelease: true}))
+	err = pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Locked: true})
+	assert.ErrorContains(t, err, `locked version 1.1.0-rc.1 of packet-3 does not satisfy ">=1.0"`)
+}
+
+func TestDepsInfoWithoutIndex(t *testing.T) {
+	ctx := context.Background()
+	pm, repoDir := newTestRepository(t)
+	require.NoError(t, os.Remove(repoDir+"/"+indexFileName))
+
+	// manifests are read from archives, nothing is downloaded to the working directory
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-2", "ver": "^2.0"}]}`), 0644))
+	graph, err := pm.Deps(ctx, "packages.json", DepsOptions{})
+	require.NoError(t, err)
+	require.Len(t, graph.Nodes, 3)
+	assert.Equal(t, []Packet{{Name: "packet-3", Ver: "<=2.0"}, {Name: "packet-1"}}, graph.Nodes["packet-2"].Packets)
+
+	pkgInfo, err := pm.Info(ctx, "packet-2")
+	require.NoError(t, err)
+	require.NotNil(t, pkgInfo.Selected)
+	assert.Equal(t, "2.1", pkgInfo.Selected.Ver)
+	assert.Equal(t, []Packet{{Name: "packet-3", Ver: "<=2.0"}, {Name: "packet-1"}}, pkgInfo.Selected.Packets)
+
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "packages.json", entries[0].Name())
+}
+
+func TestPublishToIndexConcurrent(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	repo := NewFileRepository(repoDir)
+
+	const publishers = 8
+	var wg sync.WaitGroup
+	errs := make([]error, publishers)
+	for i := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("packet-%d", i)
+			errs[i] = publishToIndex(ctx, repo, name, IndexVersion{Ver: "1.0", Archive: archivePath(name, "1.0")})
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// no version is lost and the lock is released
+	index, err := readIndex(ctx, repo)
+	require.NoError(t, err)
+	assert.Len(t, index.Packages, publishers)
+	assert.NoFileExists(t, repoDir+"/"+indexLockName)
+
+	// held lock is waited for until the context is done
+	require.NoError(t, repo.Lock(ctx, indexLockName))
+	ctx, cancel := context.WithTimeout(ctx, 3*indexLockRetry)
+	defer cancel()
+	err = publishToIndex(ctx, repo, "packet-9", IndexVersion{Ver: "1.0"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "locked by another publisher")
+
+	// pm create under a command timeout reports the held lock and uploads nothing
+	chdirTemp(t)
+	pm := NewPackageManager(repo)
+	ctx, cancel = context.WithTimeout(context.Background(), 3*indexLockRetry)
+	defer cancel()
+	err = pm.CreatePackage(ctx, "./testdata/packet-3.json", CreateOptions{})
+	assert.ErrorContains(t, err, "remove "+indexLockName)
+	assert.NoDirExists(t, repoDir+"/packet-3")
+	assert.FileExists(t, repoDir+"/"+indexLockName)
+}
+
+// newTestRepository publishes packet-1, packet-2 and packet-3 from testdata to a file repository.
+// Installed database and cache are temporary, the working directory is a temp dir with testdata.
+func newTestRepository(t *testing.T) (*PackageManager, string) {
+	t.Helper()
+	chdirTemp(t)
+	repoDir := t.TempDir()
+	t.Setenv("PACMAN_DB", t.TempDir()+"/installed.json")
+	t.Setenv("PACMAN_CACHE_DIR", t.TempDir())
+	pm := NewPackageManager(NewFileRepository(repoDir))
+	t.Cleanup(func() { pm.Close() })
+
+	for _, config := range []string{"./testdata/p.json", "./testdata/packet-2.json", "./testdata/packet-3.json"} {
+		require.NoError(t, pm.CreatePackage(context.Background(), config, CreateOptions{}))
+	}
+	return pm, repoDir
+}
+
+func TestCreateFileRepository(t *testing.T) {
+	ctx := context.Background()
+	pm, repoDir := newTestRepository(t)
+	assert.FileExists(t, repoDir+"/packet-1/packet-1-1.10.tar.gz")
+
+	versions, err := pm.repo.Versions(ctx, "packet-2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.1"}, versions)
+
+	index, err := readIndex(ctx, pm.repo)
+	require.NoError(t, err)
+	require.Len(t, index.Packages, 3)
+	v := index.find("packet-2", "2.1")
+	require.NotNil(t, v)
+	assert.Equal(t, "packet-2/packet-2-2.1.tar.gz", v.Archive)
+	assert.Equal(t, []Packet{{Name: "packet-3", Ver: "<=2.0"}, {Name: "packet-1"}}, v.Packets)
+	assert.Len(t, v.SHA256, 64)
+	assert.NotZero(t, v.Published)
+
+	// republish replaces the version
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-2.json", CreateOptions{}))
+	index, err = readIndex(ctx, pm.repo)
+	require.NoError(t, err)
+	assert.Len(t, index.Packages["packet-2"].Versions, 1)
+}
+
+func TestSearchInfo(t *testing.T) {
+	ctx := context.Background()
+	pm, _ := newTestRepository(t)
+
+	found, err := pm.SearchPackages(ctx, "packet-[12]")
+	require.NoError(t, err)
+	assert.Equal(t, []SearchResult{{Name: "packet-1", Latest: "1.10"}, {Name: "packet-2", Latest: "2.1"}}, found)
+	found, err = pm.SearchPackages(ctx, "et-3")
+	require.NoError(t, err)
+	assert.Equal(t, []SearchResult{{Name: "packet-3", Latest: "1.0"}}, found)
+
+	pkgInfo, err := pm.Info(ctx, "packet-2@^2.0")
+	require.NoError(t, err)
+	require.NotNil(t, pkgInfo.Selected)
+	assert.Equal(t, "2.1", pkgInfo.Selected.Ver)
+	assert.Equal(t, []Packet{{Name: "packet-3", Ver: "<=2.0"}, {Name: "packet-1"}}, pkgInfo.Selected.Packets)
+	assert.Len(t, pkgInfo.Manifest.Files, 2)
+	pkgInfo, err = pm.Info(ctx, "packet-2@<2.0")
+	require.NoError(t, err)
+	assert.Nil(t, pkgInfo.Selected)
+	_, err = pm.Info(ctx, "packet-9")
+	assert.Error(t, err)
+}
+
+func TestDeps(t *testing.T) {
+	ctx := context.Background()
+	pm, _ := newTestRepository(t)
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-2", "ver": "^2.0"}]}`), 0644))
+
+	graph, err := pm.Deps(ctx, "packages.json", DepsOptions{})
+	require.NoError(t, err)
+	var deps bytes.Buffer
+	require.NoError(t, graph.Print(&deps, DepsOptions{}))
+	assert.Equal(t, "packages.json\n  packet-2 ^2.0 -> 2.1\n    packet-3 <=2.0 -> 1.0\n    packet-1 * -> 1.10\n", deps.String())
+	deps.Reset()
+	require.NoError(t, graph.Print(&deps, DepsOptions{Reverse: "packet-1"}))
+	assert.Equal(t, "packet-1 1.10\n  packet-2 2.1 requires *\n    packages.json requires ^2.0\n", deps.String())
+	deps.Reset()
+	require.NoError(t, graph.Print(&deps, DepsOptions{Reverse: "packet-3", Format: "dot"}))
+	assert.Equal(t, `digraph deps {
+  "packages.json" [shape=box];
+  "packages.json" -> "packet-2 2.1" [label="^2.0"];
+  "packet-2 2.1" -> "packet-3 1.0" [label="<=2.0"];
+}
+`, deps.String())
+	graph, err = pm.Deps(ctx, "packet-2@2.1", DepsOptions{})
+	require.NoError(t, err)
+	assert.Len(t, graph.Nodes, 3)
+}
+
+func TestUpdateFileRepository(t *testing.T) {
+	ctx := context.Background()
+	pm, _ := newTestRepository(t)
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-2", "ver": "^2.0"}]}`), 0644))
+
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{}))
+	assert.FileExists(t, "testdata/package1/packet.txt")
+	assert.FileExists(t, "testdata/package/main.go")
+
+	lock, err := readLockfile("packages.lock")
+	require.NoError(t, err)
+	names := make([]string, 0, len(lock.Packages))
+	for _, lp := range lock.Packages {
+		names = append(names, lp.Name+"@"+lp.Ver)
+	}
+	assert.Equal(t, []string{"packet-3@1.0", "packet-1@1.10", "packet-2@2.1"}, names)
+
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Locked: true}))
+
+	// install to the prefix, dest of the package is relative to it
+	prefix := t.TempDir()
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-2", "ver": "^2.0", "dest": "opt/packet-2"}]}`), 0644))
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Prefix: prefix}))
+	assert.FileExists(t, prefix+"/opt/packet-2/testdata/package1/packet.txt")
+	assert.FileExists(t, prefix+"/testdata/package/main.go")
+
+	db, err := readInstalledDB(pm.db)
+	require.NoError(t, err)
+	require.Len(t, db.Packages, 3)
+	installed := db.find("packet-2")
+	require.NotNil(t, installed)
+	assert.Equal(t, "2.1", installed.Ver)
+	assert.Equal(t, prefix+"/opt/packet-2", installed.Root)
+	assert.Equal(t, []Packet{{Name: "packet-3", Ver: "<=2.0"}, {Name: "packet-1"}}, installed.Packets)
+	info, err := os.Stat(prefix + "/opt/packet-2/testdata/package1/packet.txt")
+	require.NoError(t, err)
+	assert.Contains(t, installed.Files, InstalledFile{
+		Path:   "testdata/package1/packet.txt",
+		Type:   fileTypeRegular,
+		Mode:   info.Mode().Perm(),
+		SHA256: mustSHA256(t, prefix+"/opt/packet-2/testdata/package1/packet.txt"),
+	})
+
+	var out bytes.Buffer
+	require.NoError(t, ListPackages(&out, pm.db, true))
+	assert.Contains(t, out.String(), "packet-3  1.0")
+	assert.Contains(t, out.String(), prefix+"/testdata/package/main.go")
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	pm, _ := newTestRepository(t)
+	t.Chdir(t.TempDir())
+	prefix := t.TempDir()
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-2", "ver": "^2.0", "dest": "opt/packet-2"}]}`), 0644))
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Prefix: prefix}))
+
+	issues, err := VerifyPackages(pm.db, nil)
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+
+	pkgDir := prefix + "/opt/packet-2/testdata/package1"
+	require.NoError(t, os.WriteFile(pkgDir+"/packet.txt", []byte("edited"), 0644))
+	require.NoError(t, os.Remove(pkgDir+"/packages.txt"))
+	require.NoError(t, os.WriteFile(pkgDir+"/extra.txt", []byte("extra"), 0644))
+	require.NoError(t, os.Chmod(prefix+"/testdata/package/main.go", 0600))
+
+	issues, err = VerifyPackages(pm.db, []string{"packet-2"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []VerifyIssue{
+		{Package: "packet-2", Path: pkgDir + "/packet.txt", Problem: verifyModified},
+		{Package: "packet-2", Path: pkgDir + "/packages.txt", Problem: verifyMissing},
+		{Package: "packet-2", Path: pkgDir + "/extra.txt", Problem: verifyUnexpected},
+	}, issues)
+
+	issues, err = VerifyPackages(pm.db, []string{"packet-3"})
+	require.NoError(t, err)
+	assert.Equal(t, []VerifyIssue{{Package: "packet-3", Path: prefix + "/testdata/package/main.go", Problem: verifyMode}}, issues)
+}
+
+func mustSHA256(t *testing.T, path string) string {
+	t.Helper()
+	sum, err := fileSHA256(path)
+	require.NoError(t, err)
+	return sum
+}
+
+// SFTP repository in a temp dir, the server on pipes serves the local file system
+func newSFTPTestRepository(t *testing.T) *sftpRepository {
+	t.Helper()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw})
+	require.NoError(t, err)
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(cr, cw)
+	require.NoError(t, err)
+
+	repo := &sftpRepository{client: client, root: t.TempDir()}
+	t.Cleanup(func() { repo.Close() })
+	t.Cleanup(func() { server.Close() }) // unblocks the client reader
+	return repo
+}
+
+func TestSFTPRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := newSFTPTestRepository(t)
+
+	data := []byte("archive data")
+	for _, p := range []string{"packet-1/packet-1-1.10.tar.gz", "packet-1/packet-1-1.9.tar.gz", "packet-10/packet-10-1.0.tar.gz"} {
+		require.NoError(t, repo.Upload(ctx, p, bytes.NewReader(data), int64(len(data))))
+	}
+
+	names, err := repo.Packages(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"packet-1", "packet-10"}, names)
+
+	versions, err := repo.Versions(ctx, "packet-1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.10", "1.9"}, versions)
+
+	versions, err = repo.Versions(ctx, "packet-2")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+
+	var buf bytes.Buffer
+	require.NoError(t, repo.Fetch(ctx, "packet-1/packet-1-1.10.tar.gz", &buf))
+	assert.Equal(t, data, buf.Bytes())
+
+	info, err := repo.Stat(ctx, "packet-1/packet-1-1.9.tar.gz")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), info.Size())
+
+	require.NoError(t, repo.Delete(ctx, "packet-1/packet-1-1.9.tar.gz"))
+	_, err = repo.Stat(ctx, "packet-1/packet-1-1.9.tar.gz")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, repo.Lock(ctx, indexLockName))
+	assert.ErrorIs(t, repo.Lock(ctx, indexLockName), fs.ErrExist)
+	require.NoError(t, repo.Delete(ctx, indexLockName))
+	require.NoError(t, repo.Lock(ctx, indexLockName))
+
+	assert.Error(t, repo.Upload(ctx, "../escape.tar.gz", bytes.NewReader(data), int64(len(data))))
+}
+
+func TestSFTPUploadWithoutPosixRename(t *testing.T) {
+	require.NoError(t, sftp.SetSFTPExtensions("statvfs@openssh.com"))
+	t.Cleanup(func() {
+		sftp.SetSFTPExtensions("hardlink@openssh.com", "posix-rename@openssh.com", "statvfs@openssh.com")
+	})
+	ctx := context.Background()
+	repo := newSFTPTestRepository(t)
+	_, ok := repo.client.HasExtension("posix-rename@openssh.com")
+	require.False(t, ok)
+
+	// published file is replaced, the old one is not left aside
+	for _, content := range []string{"old index", "new index"} {
+		require.NoError(t, repo.Upload(ctx, indexFileName, strings.NewReader(content), int64(len(content))))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, repo.Fetch(ctx, indexFileName, &buf))
+	assert.Equal(t, "new index", buf.String())
+	entries, err := os.ReadDir(repo.root)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// abortWriter breaks the response after limit bytes
+type abortWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *abortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		w.ResponseWriter.Write(p[:w.limit])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestHTTPRepository(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("archive data "), 1000)
+	fileRepo := NewFileRepository(root)
+	for _, p := range []string{"packet-1/packet-1-1.10.tar.gz", "packet-1/packet-1-1.9.tar.gz", "packet-10/packet-10-1.0.tar.gz"} {
+		require.NoError(t, fileRepo.Upload(ctx, p, bytes.NewReader(data), int64(len(data))))
+	}
+
+	handler := newServeHandler(root)
+	broken := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first download of the archive is interrupted
+		if strings.HasSuffix(r.URL.Path, ".tar.gz") && r.Method == http.MethodGet && broken {
+			broken = false
+			w = &abortWriter{ResponseWriter: w, limit: 100}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	repo, err := OpenRepository(srv.URL + "/")
+	require.NoError(t, err)
+	defer repo.Close()
+
+	names, err := repo.Packages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"packet-1", "packet-10"}, names)
+
+	versions, err := repo.Versions(ctx, "packet-1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.9", "1.10"}, versions)
+
+	var buf bytes.Buffer
+	require.NoError(t, repo.Fetch(ctx, "packet-1/packet-1-1.10.tar.gz", &buf))
+	assert.False(t, broken)
+	assert.Equal(t, data, buf.Bytes())
+
+	info, err := repo.Stat(ctx, "packet-10/packet-10-1.0.tar.gz")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), info.Size())
+
+	_, err = repo.Stat(ctx, "packet-10/packet-10-2.0.tar.gz")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.ErrorIs(t, repo.Upload(ctx, "packet-2/packet-2-1.0.tar.gz", bytes.NewReader(data), int64(len(data))), ErrReadOnly)
+}
+
+func TestPackageNameValidation(t *testing.T) {
+	for _, name := range []string{"packet-1", "lib_ssl.1", "g++"} {
+		assert.NoError(t, validatePackageName(name), name)
+	}
+	for _, name := range []string{"", ".ssh", "-rf", "a;rm -rf ~", "$(id)", "`id`", "a b", "a/b", "a'b"} {
+		assert.Error(t, validatePackageName(name), name)
+	}
+	assert.Error(t, checkRepoPath("$(touch x)/a.tar.gz"))
+	assert.NoError(t, checkRepoPath("packet-1/packet-1-1.0+build.1.tar.gz.sha256"))
+	assert.Equal(t, `'a'\''b; $(id)'`, shellQuote("a'b; $(id)"))
+
+	config := filepath.Join(t.TempDir(), "packages.json")
+	require.NoError(t, os.WriteFile(config, []byte(`{"packages": [{"name": "x;touch pwned"}]}`), 0644))
+	_, err := readPackagesConfig(config)
+	assert.ErrorContains(t, err, "invalid package name")
+	require.NoError(t, os.WriteFile(config, []byte(`{"name": "$(id)", "ver": "1.0", "targets": []}`), 0644))
+	_, err = readPackageConfig(config)
+	assert.ErrorContains(t, err, "invalid package name")
+}
+
+func TestSSHRemoteError(t *testing.T) {
+	missing := remoteError("stat", "index.json", &ssh.ExitError{}, []byte("stat: cannot statx '/repo/index.json': No such file or directory\n"))
+	assert.ErrorIs(t, missing, fs.ErrNotExist)
+
+	// only a missing file is fs.ErrNotExist, index and checksum reads fail on other errors
+	denied := remoteError("stat", "index.json", &ssh.ExitError{}, []byte("stat: cannot statx '/repo/index.json': Permission denied\n"))
+	assert.NotErrorIs(t, denied, fs.ErrNotExist)
+	assert.ErrorContains(t, denied, "Permission denied")
+	closed := remoteError("ls", "packet-1", io.EOF, nil)
+	assert.NotErrorIs(t, closed, fs.ErrNotExist)
+	assert.ErrorIs(t, closed, io.EOF)
+}
+
+func TestServeOnlyPackageFiles(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		".ssh/id_rsa":                         "private key",
+		"notes/secret.txt":                    "secret",
+		"packet-1/notes.txt":                  "notes",
+		"packet-1/packet-1-1.0.tar.gz":        "archive",
+		"packet-1/packet-1-1.0.tar.gz.sha256": "sum",
+		"packet-1/packet-1-1.0.tar.gz.sig":    "sig",
+		"packet-1/packet-2-1.0.tar.gz":        "other package",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0600))
+	}
+	srv := httptest.NewServer(newServeHandler(root))
+	defer srv.Close()
+
+	get := func(p string) int {
+		resp, err := http.Get(srv.URL + p)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, p := range []string{"/index.json", "/packet-1/packet-1-1.0.tar.gz", "/packet-1/packet-1-1.0.tar.gz.sha256", "/packet-1/packet-1-1.0.tar.gz.sig"} {
+		assert.Equal(t, http.StatusOK, get(p), p)
+	}
+	for _, p := range []string{"/.ssh/id_rsa", "/notes/secret.txt", "/packet-1/notes.txt", "/packet-1/packet-2-1.0.tar.gz", "/packet-1/../.ssh/id_rsa"} {
+		assert.Equal(t, http.StatusNotFound, get(p), p)
+	}
+}
+
+func TestChecksumVerification(t *testing.T) {
+	ctx := context.Background()
+	chdirTemp(t)
+	repoDir := t.TempDir()
+	pm := NewPackageManager(NewFileRepository(repoDir))
+	defer pm.Close()
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-3.json", CreateOptions{}))
+
+	sumData, err := os.ReadFile(repoDir + "/packet-3/packet-3-1.0.tar.gz.sha256")
+	require.NoError(t, err)
+	assert.Regexp(t, "^[0-9a-f]{64}  packet-3-1.0.tar.gz\n$", string(sumData))
+
+	// checksum from .sha256 file if the repository has no index
+	require.NoError(t, os.Remove(repoDir+"/"+indexFileName))
+
+	t.Chdir(t.TempDir())
+	src := newRepoSource(pm.repo)
+	archiveName, err := src.fetch(ctx, "packet-3", "1.0")
+	require.NoError(t, err)
+	assert.FileExists(t, archiveName)
+	assert.Equal(t, src.dir, filepath.Dir(archiveName))
+
+	// downloaded archives are removed with the temp dir
+	src.close()
+	assert.NoDirExists(t, src.dir)
+
+	// tampered archive is rejected and removed
+	f, err := os.OpenFile(repoDir+"/packet-3/packet-3-1.0.tar.gz", os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	f.WriteString("garbage")
+	f.Close()
+
+	src = newRepoSource(pm.repo)
+	defer src.close()
+	_, err = src.fetch(ctx, "packet-3", "1.0")
+	var ce *ChecksumError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, strings.TrimSpace(string(sumData[:64])), ce.Want)
+	assert.NoFileExists(t, filepath.Join(src.dir, archiveFileName("packet-3", "1.0")))
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPackageSignature(t *testing.T) {
+	ctx := context.Background()
+	chdirTemp(t)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := ssh.NewSignerFromKey(otherPriv)
+	require.NoError(t, err)
+
+	repoDir := t.TempDir()
+	pm := NewPackageManager(NewFileRepository(repoDir))
+	defer pm.Close()
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-3.json", CreateOptions{Signer: signer}))
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-2.json", CreateOptions{}))
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/p.json", CreateOptions{}))
+	assert.FileExists(t, repoDir+"/packet-3/packet-3-1.0.tar.gz.sig")
+
+	keysFile := t.TempDir() + "/trusted_keys"
+	require.NoError(t, os.WriteFile(keysFile, append([]byte("# publishers\n"), ssh.MarshalAuthorizedKey(signer.PublicKey())...), 0644))
+	keys, err := LoadTrustedKeys(keysFile)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	t.Chdir(t.TempDir())
+	fetch := func(policy SignaturePolicy, name, ver string) error {
+		src := newRepoSource(pm.repo)
+		src.signature = policy
+		defer src.close()
+		_, err := src.fetch(ctx, name, ver)
+		return err
+	}
+
+	assert.NoError(t, fetch(SignaturePolicy{TrustedKeys: keys, Require: true}, "packet-3", "1.0"))
+	assert.ErrorIs(t, fetch(SignaturePolicy{TrustedKeys: keys, Require: true}, "packet-2", "2.1"), ErrUnsigned)
+	assert.NoError(t, fetch(SignaturePolicy{}, "packet-2", "2.1"))
+
+	// signed by untrusted key
+	untrusted := []ssh.PublicKey{other.PublicKey()}
+	assert.ErrorContains(t, fetch(SignaturePolicy{TrustedKeys: untrusted, Require: true}, "packet-3", "1.0"), "untrusted key")
+	assert.NoError(t, fetch(SignaturePolicy{TrustedKeys: untrusted}, "packet-3", "1.0"))
+
+	// dry run refuses what the update would refuse
+	plan := func(name string, opts UpdateOptions) error {
+		require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "`+name+`"}]}`), 0644))
+		_, err := pm.PlanUpdate(ctx, "packages.json", opts)
+		return err
+	}
+	required := SignaturePolicy{TrustedKeys: keys, Require: true}
+	assert.NoError(t, plan("packet-3", UpdateOptions{Signature: required}))
+	assert.ErrorIs(t, plan("packet-2", UpdateOptions{Signature: required}), ErrUnsigned)
+	assert.ErrorContains(t, plan("packet-3", UpdateOptions{Signature: SignaturePolicy{Require: true}}), "no trusted keys")
+	assert.ErrorContains(t, plan("packet-3", UpdateOptions{MaxSize: 10}), "size limit")
+
+	// signature of other package is not valid for this one
+	sum, err := fileSHA256(repoDir + "/packet-3/packet-3-1.0.tar.gz")
+	require.NoError(t, err)
+	sig, err := signPackage(signer, "packet-3", "1.1", sum)
+	require.NoError(t, err)
+	require.NoError(t, publishSignature(ctx, pm.repo, archivePath("packet-3", "1.0"), sig))
+	assert.ErrorContains(t, fetch(SignaturePolicy{TrustedKeys: keys}, "packet-3", "1.0"), "bad signature")
+
+	// unsigned republish drops the old signature
+	chdirTemp(t)
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-3.json", CreateOptions{}))
+	assert.NoFileExists(t, repoDir+"/packet-3/packet-3-1.0.tar.gz.sig")
+	assert.NoError(t, fetch(SignaturePolicy{}, "packet-3", "1.0"))
+	assert.ErrorIs(t, fetch(SignaturePolicy{TrustedKeys: keys, Require: true}, "packet-3", "1.0"), ErrUnsigned)
+}
+
+// unpack archive to root, only error is checked
+func extractTo(root, archivePath string, maxSize int64) error {
+	_, err := newExtractor(root, maxSize).extract(archivePath)
+	return err
+}
+
+// write .tar.gz with regular files, name -> content
+func writeTarGz(t *testing.T, archivePath string, files [][2]string) {
+	t.Helper()
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     file[0],
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(file[1])),
+		}))
+		_, err := tw.Write([]byte(file[1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+}
+
+func TestSafeExtract(t *testing.T) {
+	dir := t.TempDir()
+	root := dir + "/root"
+	outside := dir + "/outside"
+	require.NoError(t, os.MkdirAll(outside, 0755))
+
+	archive := dir + "/good.tar.gz"
+	writeTarGz(t, archive, [][2]string{{"bin/tool", "tool"}, {"./etc/tool.conf", "conf"}})
+	require.NoError(t, extractTo(root, archive, 0))
+	assert.FileExists(t, root+"/bin/tool")
+	assert.FileExists(t, root+"/etc/tool.conf")
+
+	for _, name := range []string{"../escape", "bin/../../escape", "/tmp/escape", `..\escape`} {
+		writeTarGz(t, archive, [][2]string{{name, "evil"}})
+		err := extractTo(root, archive, 0)
+		assert.ErrorIs(t, err, ErrUnsafePath, name)
+	}
+	assert.NoFileExists(t, dir+"/escape")
+
+	// symlink in the root pointing outside is not followed
+	require.NoError(t, os.Symlink(outside, root+"/link"))
+	writeTarGz(t, archive, [][2]string{{"link/evil", "evil"}})
+	assert.ErrorIs(t, extractTo(root, archive, 0), ErrUnsafePath)
+	assert.NoFileExists(t, outside+"/evil")
+
+	// symlink as the file is replaced
+	require.NoError(t, os.Symlink(outside+"/passwd", root+"/passwd"))
+	writeTarGz(t, archive, [][2]string{{"passwd", "new"}})
+	require.NoError(t, extractTo(root, archive, 0))
+	assert.NoFileExists(t, outside+"/passwd")
+
+	// unpack size limit
+	writeTarGz(t, archive, [][2]string{{"a", strings.Repeat("x", 60)}, {"b", strings.Repeat("x", 60)}})
+	assert.ErrorContains(t, extractTo(root, archive, 100), "size limit")
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, "testdata/p.json", archiveEntryName(wd+"/testdata/p.json"))
+	assert.Equal(t, "etc/hosts", archiveEntryName("/etc/hosts"))
+}
+
+func TestExtractDotPrefix(t *testing.T) {
+	// archive made with tar -C dir -czf archive.tar.gz .
+	archive := t.TempDir() + "/dot.tar.gz"
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./bin/tool", Typeflag: tar.TypeReg, Mode: 0755, Size: 4}))
+	_, err = tw.Write([]byte("tool"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, f.Close())
+
+	root := t.TempDir() + "/root"
+	sp, err := stagePackage(newExtractor(root, 0), archive)
+	require.NoError(t, err)
+	tx := newTransaction()
+	tx.staging = append(tx.staging, sp.staging)
+	require.NoError(t, tx.install(sp))
+	tx.commit()
+	assert.FileExists(t, root+"/bin/tool")
+	paths := make([]string, len(sp.files))
+	for i, file := range sp.files {
+		paths[i] = file.Path
+	}
+	assert.Equal(t, []string{"bin", "bin/tool"}, paths)
+
+	f, err = os.Open(archive)
+	require.NoError(t, err)
+	defer f.Close()
+	content, err := scanArchive(f, "dot", "1.0", 0)
+	require.NoError(t, err)
+	assert.Len(t, content.files, 2)
+
+	// the root is not removed with the package, even if an older database lists it
+	files := append([]InstalledFile{{Path: ".", Type: fileTypeDir}}, sp.files...)
+	require.NoError(t, removeFiles(&InstalledPackage{Name: "dot", Root: root, Files: files}, map[string]bool{}))
+	assert.NoDirExists(t, root+"/bin")
+	assert.DirExists(t, root)
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	chdirTemp(t)
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(src+"/bin", 0755))
+	require.NoError(t, os.MkdirAll(src+"/var/empty", 0700))
+	require.NoError(t, os.WriteFile(src+"/bin/tool", []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Chmod(src+"/bin/tool", 0755))
+	require.NoError(t, os.WriteFile(src+"/conf", []byte("key=value\n"), 0640))
+	require.NoError(t, os.Chmod(src+"/conf", 0640))
+	require.NoError(t, os.Symlink("tool", src+"/bin/link"))
+	require.NoError(t, os.Link(src+"/bin/tool", src+"/bin/tool2"))
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(src+"/bin/tool", mtime, mtime))
+
+	config := t.TempDir() + "/packet-6.json"
+	require.NoError(t, os.WriteFile(config, []byte(`{"name": "packet-6", "ver": "1.0", "targets": [{"path": "`+src+`/*", "dest": "pkg"}]}`), 0644))
+	_, archiveName, err := getArch(context.Background(), config)
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	require.NoError(t, extractTo(root, archiveName, 0))
+
+	info, err := os.Stat(root + "/pkg/bin/tool")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	assert.True(t, info.ModTime().Equal(mtime))
+
+	info, err = os.Stat(root + "/pkg/conf")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	info, err = os.Stat(root + "/pkg/var/empty")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	link, err := os.Readlink(root + "/pkg/bin/link")
+	require.NoError(t, err)
+	assert.Equal(t, "tool", link)
+
+	tool, err := os.Stat(root + "/pkg/bin/tool")
+	require.NoError(t, err)
+	tool2, err := os.Stat(root + "/pkg/bin/tool2")
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(tool, tool2))
+
+	// symlink out of the root is refused
+	archive := t.TempDir() + "/evil.tar.gz"
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, extractTo(root, archive, 0), ErrUnsafePath)
+
+	// symlink under a symlink extracted before: s/s/s is the root itself, so ../../../etc is outside
+	root = t.TempDir() + "/root"
+	f, err = os.Create(archive)
+	require.NoError(t, err)
+	gw = gzip.NewWriter(f)
+	tw = tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "s/s/s/x", Typeflag: tar.TypeSymlink, Linkname: "../../../etc"}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, extractTo(root, archive, 0), ErrUnsafePath)
+	_, err = os.Lstat(root + "/x")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestInstalledDBPath(t *testing.T) {
+	dir := t.TempDir()
+	system := dir + "/var/lib/pacman/installed.json"
+	assert.Equal(t, system, systemOrUserPath(system))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries) // the check writes nothing
+
+	// system dir can't be created, the database is per-user
+	require.NoError(t, os.MkdirAll(dir+"/var/lib", 0755))
+	require.NoError(t, os.WriteFile(dir+"/var/lib/file", nil, 0644))
+	blocked := dir + "/var/lib/file/pacman/installed.json"
+	t.Setenv("XDG_STATE_HOME", dir+"/state")
+	assert.Equal(t, dir+"/state/pacman/installed.json", systemOrUserPath(blocked))
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", dir+"/home")
+	assert.Equal(t, dir+"/home/.local/state/pacman/installed.json", systemOrUserPath(blocked))
+
+	t.Setenv("PACMAN_DB", dir+"/installed.json")
+	assert.Equal(t, dir+"/installed.json", installedDBPath())
+}
+
+func TestCacheDirPath(t *testing.T) {
+	dir := t.TempDir()
+	assert.Equal(t, dir+"/var/cache/pacman", systemOrUserCacheDir(dir+"/var/cache/pacman"))
+
+	// system cache can't be created, archives are cached per-user
+	require.NoError(t, os.WriteFile(dir+"/file", nil, 0644))
+	t.Setenv("XDG_CACHE_HOME", dir+"/cache")
+	assert.Equal(t, dir+"/cache/pacman", systemOrUserCacheDir(dir+"/file/pacman"))
+
+	t.Setenv("PACMAN_CACHE_DIR", dir+"/archives")
+	assert.Equal(t, dir+"/archives", cacheDirPath())
+}
+
+func TestRemovePackages(t *testing.T) {
+	root := t.TempDir()
+	dbPath := t.TempDir() + "/installed.json"
+	install := func() {
+		for _, p := range []string{"bin/tool", "lib/dep.so", "etc/tool.conf"} {
+			require.NoError(t, os.MkdirAll(filepath.Dir(root+"/"+p), 0755))
+			require.NoError(t, os.WriteFile(root+"/"+p, []byte(p), 0644))
+		}
+		db := &InstalledDB{}
+		db.set(InstalledPackage{Name: "tool", Ver: "1.0", Root: root, Explicit: true,
+			Packets: []Packet{{Name: "dep"}},
+			Files: []InstalledFile{
+				{Path: "bin", Type: fileTypeDir},
+				{Path: "bin/tool", Type: fileTypeRegular},
+				{Path: "etc/tool.conf", Type: fileTypeRegular},
+			}})
+		db.set(InstalledPackage{Name: "dep", Ver: "2.0", Root: root,
+			Files: []InstalledFile{{Path: "lib/dep.so", Type: fileTypeRegular}}})
+		require.NoError(t, db.write(dbPath))
+	}
+
+	install()
+	assert.ErrorContains(t, RemovePackages(dbPath, []string{"dep"}, RemoveOptions{}), "dep is required by tool 1.0")
+	assert.ErrorContains(t, RemovePackages(dbPath, []string{"other"}, RemoveOptions{}), "not installed")
+
+	require.NoError(t, RemovePackages(dbPath, []string{"tool"}, RemoveOptions{}))
+	assert.NoDirExists(t, root+"/bin")
+	assert.NoDirExists(t, root+"/etc")
+	assert.FileExists(t, root+"/lib/dep.so")
+	assert.DirExists(t, root)
+	db, err := readInstalledDB(dbPath)
+	require.NoError(t, err)
+	assert.Nil(t, db.find("tool"))
+	assert.NotNil(t, db.find("dep"))
+
+	// orphaned dependency is removed with --cascade
+	install()
+	require.NoError(t, RemovePackages(dbPath, []string{"tool"}, RemoveOptions{Cascade: true}))
+	assert.NoDirExists(t, root+"/lib")
+	db, err = readInstalledDB(dbPath)
+	require.NoError(t, err)
+	assert.Empty(t, db.Packages)
+}
+
+func TestUpgradePackage(t *testing.T) {
+	ctx := context.Background()
+	chdirTemp(t)
+	dbPath := t.TempDir() + "/installed.json"
+	t.Setenv("PACMAN_DB", dbPath)
+	t.Setenv("PACMAN_CACHE_DIR", t.TempDir())
+	pm := NewPackageManager(NewFileRepository(t.TempDir()))
+	defer pm.Close()
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	config := t.TempDir() + "/packet-3.json"
+	require.NoError(t, os.WriteFile(config, []byte(`{"name": "packet-3", "ver": "1.1", "targets": [{"path": "`+wd+`/testdata/package1/main.go", "dest": "lib"}]}`), 0644))
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-3.json", CreateOptions{}))
+	require.NoError(t, pm.CreatePackage(ctx, config, CreateOptions{}))
+
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-3", "ver": "1.0"}]}`), 0644))
+
+	// dry run writes nothing
+	plan, err := pm.PlanUpdate(ctx, "packages.json", UpdateOptions{})
+	require.NoError(t, err)
+	require.Len(t, plan.Packages, 1)
+	assert.Equal(t, planInstall, plan.Packages[0].Action)
+	assert.Equal(t, []string{"testdata/package/main.go"}, plan.Packages[0].Added)
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{}))
+	require.FileExists(t, "testdata/package/main.go")
+	assert.NoFileExists(t, "packet-3-1.0.tar.gz") // downloaded to a temp dir
+	plan, err = pm.PlanUpdate(ctx, "packages.json", UpdateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, planCurrent, plan.Packages[0].Action)
+
+	// up to date package is skipped, --force reinstalls it
+	require.NoError(t, os.WriteFile("testdata/package/main.go", []byte("changed"), 0644))
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{}))
+	data, err := os.ReadFile("testdata/package/main.go")
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(data))
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{Force: true}))
+	data, err = os.ReadFile("testdata/package/main.go")
+	require.NoError(t, err)
+	assert.NotEqual(t, "changed", string(data))
+
+	lock, err := readLockfile("packages.lock")
+	require.NoError(t, err)
+	require.Len(t, lock.Packages, 1)
+	assert.Len(t, lock.Packages[0].SHA256, 64)
+
+	// files of the old version are removed on upgrade
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-3", "ver": "^1.1"}]}`), 0644))
+	plan, err = pm.PlanUpdate(ctx, "packages.json", UpdateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, PlannedPackage{
+		Name:      "packet-3",
+		Ver:       "1.1",
+		Installed: "1.0",
+		Dir:       plan.Packages[0].Dir,
+		Action:    planUpgrade,
+		Added:     []string{"lib/main.go"},
+		Removed:   []string{"testdata/package/main.go"},
+	}, plan.Packages[0])
+	assert.NoFileExists(t, "lib/main.go")
+
+	require.NoError(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{}))
+	assert.FileExists(t, "lib/main.go")
+	assert.NoFileExists(t, "meta-packet-3-1.0.json")
+	assert.NoDirExists(t, "testdata")
+
+	db, err := readInstalledDB(dbPath)
+	require.NoError(t, err)
+	require.NotNil(t, db.find("packet-3"))
+	assert.Equal(t, "1.1", db.find("packet-3").Ver)
+	require.Len(t, db.find("packet-3").Generations, 1)
+	assert.Equal(t, "1.0", db.find("packet-3").Generations[0].Ver)
+
+	// rollback restores the previous version from the cache without the repository
+	cacheDir := os.Getenv("PACMAN_CACHE_DIR")
+	assert.FileExists(t, cacheDir+"/packet-3/packet-3-1.0.tar.gz")
+	require.NoError(t, RollbackPackage(dbPath, cacheDir, "packet-3", RollbackOptions{Generations: 1}))
+	assert.FileExists(t, "testdata/package/main.go")
+	assert.NoFileExists(t, "lib/main.go")
+	db, err = readInstalledDB(dbPath)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", db.find("packet-3").Ver)
+	assert.Equal(t, "1.1", db.find("packet-3").Generations[0].Ver)
+
+	assert.ErrorContains(t, RollbackPackage(dbPath, cacheDir, "packet-3", RollbackOptions{To: "0.9", Generations: 1}), "not kept")
+	require.NoError(t, RollbackPackage(dbPath, cacheDir, "packet-3", RollbackOptions{To: "1.1", Generations: 1}))
+	assert.FileExists(t, "lib/main.go")
+	assert.NoFileExists(t, "testdata/package/main.go")
+}
+
+func TestUpdateRollback(t *testing.T) {
+	ctx := context.Background()
+	chdirTemp(t)
+	dbPath := t.TempDir() + "/installed.json"
+	t.Setenv("PACMAN_DB", dbPath)
+	t.Setenv("PACMAN_CACHE_DIR", t.TempDir())
+	pm := NewPackageManager(NewFileRepository(t.TempDir()))
+	defer pm.Close()
+	require.NoError(t, pm.CreatePackage(ctx, "./testdata/packet-3.json", CreateOptions{}))
+
+	bad := t.TempDir() + "/bad.tar.gz"
+	writeTarGz(t, bad, [][2]string{{"bin/bad", "bad"}, {"../evil", "evil"}})
+	f, err := os.Open(bad)
+	require.NoError(t, err)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.NoError(t, pm.repo.Upload(ctx, archivePath("bad", "1.0"), f, info.Size()))
+	f.Close()
+
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-3"}, {"name": "bad"}]}`), 0644))
+	assert.ErrorIs(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{}), ErrUnsafePath)
+	assert.NoDirExists(t, "testdata")
+	assert.NoDirExists(t, "bin")
+	assert.NoFileExists(t, dbPath)
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), ".pacman-"), e.Name())
+	}
+
+	// archive can't be cached for rollback, nothing is installed
+	require.NoError(t, os.WriteFile("packages.json", []byte(`{"packages": [{"name": "packet-3"}]}`), 0644))
+	blocker := t.TempDir() + "/file"
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	pm.cache = blocker + "/cache"
+	assert.ErrorContains(t, pm.UpdatePackages(ctx, "packages.json", UpdateOptions{}), "failed to create cache dir")
+	assert.NoDirExists(t, "testdata")
+	assert.NoFileExists(t, dbPath)
+
+	// failure while files are moved in place undoes applied changes
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(root+"/a", []byte("old"), 0644))
+	require.NoError(t, os.MkdirAll(root+"/c", 0755))
+
+	archive := t.TempDir() + "/pkg.tar.gz"
+	writeTarGz(t, archive, [][2]string{{"a", "new"}, {"b/file", "new"}, {"c", "file over dir"}})
+	sp, err := stagePackage(newExtractor(root, 0), archive)
+	require.NoError(t, err)
+	tx := newTransaction()
+	tx.staging = append(tx.staging, sp.staging)
+	require.ErrorContains(t, tx.install(sp), "directory exists")
+	require.NoError(t, tx.rollback())
+
+	data, err := os.ReadFile(root + "/a")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+	assert.NoDirExists(t, root+"/b")
+	assert.DirExists(t, root+"/c")
+	entries, err = os.ReadDir(root)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// two packages of one update replace the same file, rollback restores the original
+	for i, content := range []string{"first", "second"} {
+		archive := fmt.Sprintf("%s/pkg%d.tar.gz", t.TempDir(), i)
+		writeTarGz(t, archive, [][2]string{{"a", content}})
+		sp, err := stagePackage(newExtractor(root, 0), archive)
+		require.NoError(t, err)
+		tx.staging = append(tx.staging, sp.staging)
+		require.NoError(t, tx.install(sp))
+	}
+	data, err = os.ReadFile(root + "/a")
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	require.NoError(t, tx.rollback())
+	data, err = os.ReadFile(root + "/a")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+}
@@ -0,0 +1,350 @@
+package pacm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// PackagePlan is what pm create would pack
+type PackagePlan struct {
+	Archive string
+	Targets []TargetPlan
+}
+
+type TargetPlan struct {
+	Path  string
+	Files []PlannedFile
+}
+
+type PlannedFile struct {
+	Path string // path of the file on disk
+	Name string // name in the archive
+}
+
+// PlanPackage lists files matched by targets of the package config without creating the archive
+func PlanPackage(ctx context.Context, configPath string) (*PackagePlan, error) {
+	config, err := readPackageConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &PackagePlan{Archive: archiveFileName(config.Name, config.Ver)}
+	for _, target := range config.Targets {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Create package canceled: %w", ctx.Err())
+		default:
+		}
+
+		files, err := target.files()
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Path, err)
+		}
+		tp := TargetPlan{Path: target.Path}
+		for _, f := range files {
+			tp.Files = append(tp.Files, PlannedFile{Path: filepath.ToSlash(f.path), Name: f.name})
+		}
+		plan.Targets = append(plan.Targets, tp)
+	}
+	return plan, nil
+}
+
+// Print writes the archive name and files of every target, names in the archive are shown if they differ
+func (p *PackagePlan) Print(w io.Writer) {
+	fmt.Fprintln(w, p.Archive)
+	for _, tp := range p.Targets {
+		fmt.Fprintf(w, "%s (%d files)\n", tp.Path, len(tp.Files))
+		for _, f := range tp.Files {
+			if f.Name != f.Path {
+				fmt.Fprintf(w, "  %s -> %s\n", f.Path, f.Name)
+			} else {
+				fmt.Fprintf(w, "  %s\n", f.Path)
+			}
+		}
+	}
+}
+
+// actions of pm update --dry-run
+const (
+	planInstall   = "install"
+	planUpgrade   = "upgrade"
+	planDowngrade = "downgrade"
+	planReinstall = "reinstall"
+	planCurrent   = "current"
+)
+
+// UpdatePlan is what pm update would do
+type UpdatePlan struct {
+	Packages []PlannedPackage
+}
+
+type PlannedPackage struct {
+	Name      string
+	Ver       string
+	Installed string // installed version, empty if the package is not installed
+	Dir       string
+	Action    string // install, upgrade, downgrade, reinstall or current
+
+	// paths of files relative to the install dir
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+// PlanUpdate resolves packages the same way as UpdatePackages and compares them with installed ones.
+// Archives are streamed from the repository and are not saved, nothing is written.
+func (pm *PackageManager) PlanUpdate(ctx context.Context, configPath string, opts UpdateOptions) (*UpdatePlan, error) {
+	if opts.Signature.Require && len(opts.Signature.TrustedKeys) == 0 {
+		return nil, fmt.Errorf("signatures are required, but no trusted keys are configured")
+	}
+
+	src := newRepoSource(pm.repo)
+	src.stream = true
+	src.signature = opts.Signature
+	src.maxSize = opts.MaxSize
+
+	config, lock, packets, err := resolveUpdate(ctx, src, configPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := readInstalledDB(pm.db)
+	if err != nil {
+		return nil, err
+	}
+	dests := make(map[string]string, len(config.Packages))
+	for _, pkg := range config.Packages {
+		dests[pkg.Name] = pkg.Dest
+	}
+
+	plan := &UpdatePlan{}
+	for _, rp := range packets {
+		dir, err := filepath.Abs(installDir(opts.Prefix, dests[rp.Name]))
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", rp.Name, err)
+		}
+		pp := PlannedPackage{Name: rp.Name, Ver: rp.Ver, Dir: dir}
+		installed := db.find(rp.Name)
+		switch {
+		case installed == nil:
+			pp.Action = planInstall
+		case !opts.Force && installed.upToDate(rp.Ver, dir, lock):
+			pp.Action = planCurrent
+		case compareVersions(rp.Ver, installed.Ver) > 0:
+			pp.Action = planUpgrade
+		case compareVersions(rp.Ver, installed.Ver) < 0:
+			pp.Action = planDowngrade
+		default:
+			pp.Action = planReinstall
+		}
+		if installed != nil {
+			pp.Installed = installed.Ver
+		}
+		if pp.Action == planCurrent {
+			plan.Packages = append(plan.Packages, pp)
+			continue
+		}
+
+		content, err := src.scan(ctx, rp.Name, rp.Ver)
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", rp.Name, err)
+		}
+		if opts.Locked {
+			if want := lock.find(rp.Name).SHA256; content.sha256 != want {
+				return nil, fmt.Errorf("package %s %s: checksum mismatch: lockfile %s, repository %s", rp.Name, rp.Ver, want, content.sha256)
+			}
+		}
+		var old []InstalledFile
+		if installed != nil {
+			old = installed.Files
+		}
+		pp.Added, pp.Changed, pp.Removed = diffFiles(old, content.files)
+		plan.Packages = append(plan.Packages, pp)
+	}
+	return plan, nil
+}
+
+// Print writes packages with actions and their changed files: + added, ~ changed, - removed
+func (p *UpdatePlan) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tINSTALLED\tACTION\tDIR")
+	for _, pp := range p.Packages {
+		installed := pp.Installed
+		if installed == "" {
+			installed = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", pp.Name, pp.Ver, installed, pp.Action, pp.Dir)
+		for _, f := range pp.Added {
+			fmt.Fprintf(tw, "  + %s\n", f)
+		}
+		for _, f := range pp.Changed {
+			fmt.Fprintf(tw, "  ~ %s\n", f)
+		}
+		for _, f := range pp.Removed {
+			fmt.Fprintf(tw, "  - %s\n", f)
+		}
+	}
+	return tw.Flush()
+}
+
+// files added, changed and removed by the archive, directories are not listed
+func diffFiles(installed, archived []InstalledFile) (added, changed, removed []string) {
+	old := make(map[string]InstalledFile, len(installed))
+	for _, f := range installed {
+		old[f.Path] = f
+	}
+	inArchive := make(map[string]bool, len(archived))
+	for _, f := range archived {
+		inArchive[f.Path] = true
+		if f.Type == fileTypeDir {
+			continue
+		}
+		o, ok := old[f.Path]
+		switch {
+		case !ok:
+			added = append(added, f.Path)
+		case o.Type != f.Type || o.SHA256 != f.SHA256 || o.Link != f.Link:
+			changed = append(changed, f.Path)
+		}
+	}
+	for _, f := range installed {
+		if f.Type != fileTypeDir && !inArchive[f.Path] {
+			removed = append(removed, f.Path)
+		}
+	}
+	return added, changed, removed
+}
+
+// archiveContent is read from the archive streamed from the repository
+type archiveContent struct {
+	manifest *Manifest
+	files    []InstalledFile // entries as the extractor would install them
+	sha256   string
+}
+
+// scan streams the archive of the package without saving it, the published checksum and the signature are verified
+func (src *repoSource) scan(ctx context.Context, name, ver string) (*archiveContent, error) {
+	key := name + "@" + ver
+	if content, ok := src.scanned[key]; ok {
+		return content, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.repo.Fetch(ctx, archivePath(name, ver), pw))
+	}()
+	defer pr.Close() // stops the download if the archive is not read to the end
+
+	h := sha256.New()
+	content, err := scanArchive(io.TeeReader(pr, h), name, ver, src.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, pr); err != nil {
+		return nil, fmt.Errorf("failed to download archive from repository: %w", err)
+	}
+	content.sha256 = hex.EncodeToString(h.Sum(nil))
+
+	want, err := src.checksum(ctx, name, ver)
+	if err != nil {
+		return nil, err
+	}
+	if want != "" && want != content.sha256 {
+		return nil, &ChecksumError{Path: archivePath(name, ver), Want: want, Got: content.sha256}
+	}
+	sig, err := fetchSignature(ctx, src.repo, archivePath(name, ver))
+	if err != nil {
+		return nil, err
+	}
+	if err := src.signature.verify(sig, name, ver, content.sha256); err != nil {
+		return nil, err
+	}
+	src.scanned[key] = content
+	return content, nil
+}
+
+// scanArchive lists entries of .tar.gz and hashes regular files, the manifest is parsed.
+// Archives larger than maxSize unpacked are refused as by the extractor.
+func scanArchive(r io.Reader, packName, ver string, maxSize int64) (*archiveContent, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxUnpackSize
+	}
+	remain := maxSize
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gr.Close()
+
+	content := &archiveContent{}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar: %w", err)
+		}
+		name, err := entryName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+		if isManifestEntry(name) {
+			if header.Typeflag == tar.TypeReg {
+				m, _, err := parseManifestEntry(header, tr, packName, ver)
+				if err != nil {
+					return nil, err
+				}
+				if m != nil {
+					content.manifest = m
+				}
+			}
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			content.files = append(content.files, InstalledFile{Path: name, Type: fileTypeDir})
+		case tar.TypeReg:
+			if header.Size > remain {
+				return nil, fmt.Errorf("archive exceeds unpack size limit of %d bytes", maxSize)
+			}
+			remain -= header.Size
+			h := sha256.New()
+			// legacy meta file is installed as a regular file
+			m, _, err := parseManifestEntry(header, io.TeeReader(tr, h), packName, ver)
+			if err != nil {
+				return nil, err
+			}
+			if m != nil && content.manifest == nil {
+				content.manifest = m
+			}
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			content.files = append(content.files, InstalledFile{Path: name, Type: fileTypeRegular, SHA256: hex.EncodeToString(h.Sum(nil))})
+		case tar.TypeSymlink:
+			content.files = append(content.files, InstalledFile{Path: name, Type: fileTypeSymlink, Link: header.Linkname})
+		case tar.TypeLink:
+			target, err := entryName(header.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			content.files = append(content.files, InstalledFile{Path: name, Type: fileTypeHardlink, Link: target})
+		}
+	}
+	if content.manifest == nil {
+		content.manifest = &Manifest{Name: packName, Ver: ver}
+	}
+	return content, nil
+}
@@ -0,0 +1,188 @@
+package pacm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// RemoveOptions tune pm remove
+type RemoveOptions struct {
+	Cascade bool // also remove dependencies which are not needed by other packages
+}
+
+// RemovePackages uninstalls packages: deletes their files, empty directories and records in the database.
+// A package required by another installed package is not removed.
+func RemovePackages(dbPath string, names []string, opts RemoveOptions) error {
+	db, err := readInstalledDB(dbPath)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[string]bool, len(names))
+	for _, name := range names {
+		if db.find(name) == nil {
+			return fmt.Errorf("package %s is not installed", name)
+		}
+		remove[name] = true
+	}
+	if opts.Cascade {
+		for _, name := range db.orphans(remove) {
+			slog.Info("Remove orphaned dependency", "package", name)
+			remove[name] = true
+		}
+	}
+	if err := db.checkDependents(remove); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, pkg := range slices.Clone(db.Packages) {
+		if !remove[pkg.Name] {
+			continue
+		}
+		lg := slog.With("package", pkg.Name, "version", pkg.Ver)
+		lg.Info("Remove package", "root", pkg.Root)
+		if err := removeFiles(&pkg, db.ownedFiles(remove)); err != nil {
+			lg.Error("failed to remove package", "error", err)
+			errs = append(errs, fmt.Errorf("package %s: %w", pkg.Name, err))
+			continue
+		}
+		db.remove(pkg.Name)
+	}
+
+	if err := db.write(dbPath); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkDependents fails if a package which stays installed depends on a removed one
+func (db *InstalledDB) checkDependents(remove map[string]bool) error {
+	for _, pkg := range db.Packages {
+		if remove[pkg.Name] {
+			continue
+		}
+		for _, dep := range pkg.Packets {
+			if remove[dep.Name] {
+				return fmt.Errorf("package %s is required by %s %s", dep.Name, pkg.Name, pkg.Ver)
+			}
+		}
+	}
+	return nil
+}
+
+// orphans are dependencies of removed packages which were not installed explicitly
+// and are not required by packages that stay installed
+func (db *InstalledDB) orphans(remove map[string]bool) []string {
+	removed := maps.Clone(remove)
+	var res []string
+	for changed := true; changed; {
+		changed = false
+		for _, pkg := range db.Packages {
+			if removed[pkg.Name] || pkg.Explicit || !db.requiredOnlyBy(pkg.Name, removed) {
+				continue
+			}
+			removed[pkg.Name] = true
+			res = append(res, pkg.Name)
+			changed = true
+		}
+	}
+	return res
+}
+
+// requiredOnlyBy reports if the package is a dependency of removed packages only
+func (db *InstalledDB) requiredOnlyBy(name string, removed map[string]bool) bool {
+	required := false
+	for _, pkg := range db.Packages {
+		if !slices.ContainsFunc(pkg.Packets, func(p Packet) bool { return p.Name == name }) {
+			continue
+		}
+		if !removed[pkg.Name] {
+			return false
+		}
+		required = true
+	}
+	return required
+}
+
+// ownedFiles are absolute paths of files of installed packages except skipped ones
+func (db *InstalledDB) ownedFiles(skip map[string]bool) map[string]bool {
+	owned := make(map[string]bool)
+	for _, pkg := range db.Packages {
+		if skip[pkg.Name] {
+			continue
+		}
+		for _, f := range pkg.Files {
+			owned[filepath.Join(pkg.Root, filepath.FromSlash(f.Path))] = true
+		}
+	}
+	return owned
+}
+
+// removeFiles deletes files of the package which are not owned by installed packages,
+// then directories which became empty, the install root itself is kept
+func removeFiles(pkg *InstalledPackage, owned map[string]bool) error {
+	files, dirs := unownedFiles(pkg, owned)
+	var errs []error
+	for _, p := range files {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err := removeEmptyDirs(dirs); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// unownedFiles are absolute paths of files of the package not owned by installed packages
+// and directories of the package below its root
+func unownedFiles(pkg *InstalledPackage, owned map[string]bool) (files, dirs []string) {
+	dirSet := make(map[string]bool)
+	for _, f := range pkg.Files {
+		p := filepath.Join(pkg.Root, filepath.FromSlash(f.Path))
+		for dir := filepath.Dir(p); dir != pkg.Root && strings.HasPrefix(dir, pkg.Root); dir = filepath.Dir(dir) {
+			dirSet[dir] = !owned[dir]
+		}
+		if f.Type == fileTypeDir {
+			// databases written before "./" entries were skipped may list the root itself
+			if p != pkg.Root {
+				dirSet[p] = !owned[p]
+			}
+			continue
+		}
+		if owned[p] {
+			slog.Debug("Keep file of other package", "path", p)
+			continue
+		}
+		files = append(files, p)
+	}
+	for dir, remove := range dirSet {
+		if remove {
+			dirs = append(dirs, dir)
+		}
+	}
+	return files, dirs
+}
+
+// removeEmptyDirs removes directories deepest first, not empty directories are kept
+func removeEmptyDirs(dirs []string) error {
+	slices.SortFunc(dirs, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	var errs []error
+	for _, dir := range dirs {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+			if err := os.Remove(dir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package pacm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileRepository keeps archives in a local directory
+type fileRepository struct {
+	root string
+}
+
+func NewFileRepository(root string) Repository {
+	return &fileRepository{root: root}
+}
+
+func (r *fileRepository) localPath(p string) (string, error) {
+	if err := checkRepoPath(p); err != nil {
+		return "", err
+	}
+	return filepath.Join(r.root, filepath.FromSlash(p)), nil
+}
+
+func (r *fileRepository) Packages(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository dir: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (r *fileRepository) Versions(ctx context.Context, name string) ([]string, error) {
+	dir, err := r.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read package dir: %w", err)
+	}
+
+	fileNames := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			fileNames = append(fileNames, e.Name())
+		}
+	}
+	return versionsFromFileNames(name, fileNames), nil
+}
+
+func (r *fileRepository) Fetch(ctx context.Context, p string, w io.Writer) error {
+	lp, err := r.localPath(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(lp)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", p, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	return nil
+}
+
+// Upload writes to a temporary file and renames it, so readers never see a partial file
+func (r *fileRepository) Upload(ctx context.Context, p string, rd io.Reader, size int64) error {
+	lp, err := r.localPath(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(lp), 0755); err != nil {
+		return fmt.Errorf("can't create dir for %s: %w", p, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(lp), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, rd); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", p, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to chmod %s: %w", p, err)
+	}
+	if err := os.Rename(tmp.Name(), lp); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", p, err)
+	}
+	return nil
+}
+
+func (r *fileRepository) Delete(ctx context.Context, p string) error {
+	lp, err := r.localPath(p)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(lp); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", p, err)
+	}
+	return nil
+}
+
+func (r *fileRepository) Lock(ctx context.Context, p string) error {
+	lp, err := r.localPath(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(lp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (r *fileRepository) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	lp, err := r.localPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(lp)
+}
+
+func (r *fileRepository) Close() error {
+	return nil
+}
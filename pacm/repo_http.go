@@ -0,0 +1,186 @@
+package pacm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly is returned by write operations of read-only repositories
+var ErrReadOnly = errors.New("repository is read-only")
+
+// download attempts, interrupted downloads are resumed by range requests
+const httpFetchAttempts = 3
+
+// httpRepository is a read-only repository served by pm serve
+type httpRepository struct {
+	base   *url.URL
+	client *http.Client
+
+	mu    sync.Mutex
+	index *RepoIndex
+}
+
+func NewHTTPRepository(baseURL string) (Repository, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL %q: %w", baseURL, err)
+	}
+	return &httpRepository{
+		base:   u,
+		client: &http.Client{},
+	}, nil
+}
+
+func (r *httpRepository) url(p string) (string, error) {
+	if err := checkRepoPath(p); err != nil {
+		return "", err
+	}
+	return r.base.JoinPath(p).String(), nil
+}
+
+func (r *httpRepository) get(ctx context.Context, method, p string, header http.Header) (*http.Response, error) {
+	u, err := r.url(p)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, u, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &fs.PathError{Op: method, Path: p, Err: fs.ErrNotExist}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected status %s", method, u, resp.Status)
+	}
+}
+
+// index of the repository is downloaded once
+func (r *httpRepository) getIndex(ctx context.Context) (*RepoIndex, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index != nil {
+		return r.index, nil
+	}
+
+	resp, err := r.get(ctx, http.MethodGet, indexFileName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download repository index: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var index RepoIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to parse repository index: %w", err)
+	}
+	r.index = &index
+	return r.index, nil
+}
+
+func (r *httpRepository) Packages(ctx context.Context) ([]string, error) {
+	index, err := r.getIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Sorted(maps.Keys(index.Packages)), nil
+}
+
+func (r *httpRepository) Versions(ctx context.Context, name string) ([]string, error) {
+	index, err := r.getIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := index.Packages[name]
+	if !ok {
+		return nil, nil
+	}
+	versions := make([]string, 0, len(pkg.Versions))
+	for _, v := range pkg.Versions {
+		versions = append(versions, v.Ver)
+	}
+	return versions, nil
+}
+
+func (r *httpRepository) Fetch(ctx context.Context, p string, w io.Writer) error {
+	var written int64
+	for attempt := 1; ; attempt++ {
+		header := http.Header{}
+		if written > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+		}
+
+		resp, err := r.get(ctx, http.MethodGet, p, header)
+		if err != nil {
+			return err
+		}
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return fmt.Errorf("failed to resume download of %s: server does not support range requests", p)
+		}
+
+		n, err := io.Copy(w, resp.Body)
+		resp.Body.Close()
+		written += n
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || attempt >= httpFetchAttempts {
+			return fmt.Errorf("failed to download %s: %w", p, err)
+		}
+		slog.Warn("Download interrupted, resume", "path", p, "written", written, "error", err)
+	}
+}
+
+func (r *httpRepository) Upload(ctx context.Context, p string, rd io.Reader, size int64) error {
+	return ErrReadOnly
+}
+
+func (r *httpRepository) Delete(ctx context.Context, p string) error {
+	return ErrReadOnly
+}
+
+func (r *httpRepository) Lock(ctx context.Context, p string) error {
+	return ErrReadOnly
+}
+
+func (r *httpRepository) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	resp, err := r.get(ctx, http.MethodHead, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	return &remoteFileInfo{name: path.Base(p), size: size, modTime: modTime}, nil
+}
+
+func (r *httpRepository) Close() error {
+	r.client.CloseIdleConnections()
+	return nil
+}
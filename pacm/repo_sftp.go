@@ -0,0 +1,229 @@
+package pacm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpRepository keeps archives on the SSH server and works over SFTP,
+// so it doesn't depend on the remote shell
+type sftpRepository struct {
+	sshClient *ssh.Client
+	client    *sftp.Client
+	root      string
+}
+
+func NewSFTPRepository(server, user, keyPath, root string) (Repository, error) {
+	sshClient, err := dialSSH(server, user, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	return &sftpRepository{
+		sshClient: sshClient,
+		client:    client,
+		root:      root,
+	}, nil
+}
+
+func (r *sftpRepository) remotePath(p string) (string, error) {
+	if err := checkRepoPath(p); err != nil {
+		return "", err
+	}
+	return path.Join(r.root, p), nil
+}
+
+// pathError wraps SFTP errors into *fs.PathError, so callers can check them with errors.Is(err, fs.ErrNotExist)
+func pathError(op, p string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	var se *sftp.StatusError
+	if errors.As(err, &se) {
+		switch se.FxCode() {
+		case sftp.ErrSSHFxNoSuchFile:
+			err = fs.ErrNotExist
+		case sftp.ErrSSHFxPermissionDenied:
+			err = fs.ErrPermission
+		}
+	}
+	return &fs.PathError{Op: op, Path: p, Err: err}
+}
+
+func (r *sftpRepository) Packages(ctx context.Context) ([]string, error) {
+	infos, err := r.client.ReadDirContext(ctx, path.Join(r.root, "."))
+	if err != nil {
+		return nil, pathError("readdir", ".", err)
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (r *sftpRepository) Versions(ctx context.Context, name string) ([]string, error) {
+	dir, err := r.remotePath(name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := r.client.ReadDirContext(ctx, dir)
+	if err != nil {
+		err = pathError("readdir", name, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	fileNames := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			fileNames = append(fileNames, info.Name())
+		}
+	}
+	return versionsFromFileNames(name, fileNames), nil
+}
+
+func (r *sftpRepository) Fetch(ctx context.Context, p string, w io.Writer) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	f, err := r.client.Open(remotePath)
+	if err != nil {
+		return pathError("open", p, err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteTo(w); err != nil {
+		return pathError("read", p, err)
+	}
+	return nil
+}
+
+// Upload writes to a temporary file and renames it, so readers never see a partial file
+func (r *sftpRepository) Upload(ctx context.Context, p string, rd io.Reader, size int64) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	if err := r.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return pathError("mkdir", path.Dir(p), err)
+	}
+
+	tmpPath := path.Join(path.Dir(remotePath), ".upload-"+path.Base(remotePath))
+	f, err := r.client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return pathError("create", p, err)
+	}
+	_, err = f.ReadFrom(rd)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		r.client.Remove(tmpPath)
+		return pathError("write", p, err)
+	}
+
+	if err := r.client.Chmod(tmpPath, 0644); err != nil {
+		r.client.Remove(tmpPath)
+		return pathError("chmod", p, err)
+	}
+	if err := r.replace(tmpPath, remotePath); err != nil {
+		r.client.Remove(tmpPath)
+		return pathError("rename", p, err)
+	}
+	return nil
+}
+
+// replace renames tmpPath over remotePath. Without posix-rename extension (e.g. Windows OpenSSH)
+// rename fails if the target exists, the old file is moved aside and restored if rename fails.
+func (r *sftpRepository) replace(tmpPath, remotePath string) error {
+	if _, ok := r.client.HasExtension("posix-rename@openssh.com"); ok {
+		return r.client.PosixRename(tmpPath, remotePath)
+	}
+
+	oldPath := path.Join(path.Dir(remotePath), ".old-"+path.Base(remotePath))
+	r.client.Remove(oldPath) // left by an interrupted upload
+	if err := r.client.Rename(remotePath, oldPath); err != nil {
+		if !errors.Is(pathError("rename", remotePath, err), fs.ErrNotExist) {
+			return err
+		}
+		oldPath = "" // nothing is published yet
+	}
+	if err := r.client.Rename(tmpPath, remotePath); err != nil {
+		if oldPath != "" {
+			r.client.Rename(oldPath, remotePath)
+		}
+		return err
+	}
+	if oldPath != "" {
+		r.client.Remove(oldPath)
+	}
+	return nil
+}
+
+func (r *sftpRepository) Delete(ctx context.Context, p string) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Remove(remotePath); err != nil {
+		return pathError("remove", p, err)
+	}
+	return nil
+}
+
+func (r *sftpRepository) Lock(ctx context.Context, p string) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	f, err := r.client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// SFTP v3 has no status for an existing file, it is checked by stat
+		if _, serr := r.client.Stat(remotePath); serr == nil {
+			return &fs.PathError{Op: "lock", Path: p, Err: fs.ErrExist}
+		}
+		return pathError("lock", p, err)
+	}
+	return f.Close()
+}
+
+func (r *sftpRepository) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := r.client.Stat(remotePath)
+	if err != nil {
+		return nil, pathError("stat", p, err)
+	}
+	return info, nil
+}
+
+func (r *sftpRepository) Close() error {
+	err := r.client.Close()
+	if r.sshClient != nil {
+		err = r.sshClient.Close()
+	}
+	return err
+}
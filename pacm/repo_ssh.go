@@ -0,0 +1,276 @@
+package pacm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// sshRepository keeps archives on the SSH server, files are copied by SCP
+type sshRepository struct {
+	sshClient *ssh.Client
+	client    scp.Client
+	root      string
+}
+
+func NewSSHRepository(server, user, keyPath, root string) (Repository, error) {
+	sshClient, err := dialSSH(server, user, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new SCP client, note that this function might
+	// return an error, as a new SSH session is established using the existing connecton
+	client, err := scp.NewClientBySSH(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("error creating new SSH session from existing connection: %w", err)
+	}
+
+	return &sshRepository{
+		sshClient: sshClient,
+		client:    client,
+		root:      root,
+	}, nil
+}
+
+func dialSSH(server, user, keyPath string) (*ssh.Client, error) {
+	signer, err := loadSSHSigner(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	sshClient, err := ssh.Dial("tcp", server, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server: %w", err)
+	}
+	return sshClient, nil
+}
+
+var (
+	signersMu sync.Mutex
+	signers   = make(map[string]ssh.Signer) // loaded keys by path
+)
+
+// load private SSH key, the passphrase of protected key is taken
+// from PACMAN_SSH_KEY_PASS or asked in the terminal.
+// The key is loaded once, so the same key may be used for connection and package signing.
+func loadSSHSigner(keyPath string) (ssh.Signer, error) {
+	signersMu.Lock()
+	defer signersMu.Unlock()
+	if signer, ok := signers[keyPath]; ok {
+		return signer, nil
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %v", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			// missing passphrase for protected SSH key
+			var passphrase []byte
+			pass, ok := os.LookupEnv("PACMAN_SSH_KEY_PASS")
+
+			if !ok {
+				fmt.Print("Enter passphrase for SSH key: ")
+				passphrase, err = term.ReadPassword(int(os.Stdin.Fd()))
+				if err != nil {
+					return nil, fmt.Errorf("failed to read passphrase: %v", err)
+				}
+
+				fmt.Println()
+			} else {
+				passphrase = []byte(pass)
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse SSH key with passphrase: %v", err)
+			}
+		} else {
+			return nil, fmt.Errorf("failed to parse SSH key: %v", err)
+		}
+	}
+	signers[keyPath] = signer
+	return signer, nil
+}
+
+func (r *sshRepository) remotePath(p string) (string, error) {
+	if err := checkRepoPath(p); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", r.root, p), nil
+}
+
+// run command in a new SSH session
+func (r *sshRepository) run(cmd string) ([]byte, error) {
+	session, err := r.sshClient.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("can't create SSH session: %w", err)
+	}
+	defer session.Close()
+
+	return session.CombinedOutput(cmd)
+}
+
+func (r *sshRepository) Packages(ctx context.Context) ([]string, error) {
+	rootPath, err := r.remotePath(".")
+	if err != nil {
+		return nil, err
+	}
+	// directories are listed with trailing slash
+	cmd := fmt.Sprintf("ls -1 -p %s", shellQuote(rootPath))
+	output, err := r.run(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	var names []string
+	for line := range strings.SplitSeq(string(output), "\n") {
+		if name, ok := strings.CutSuffix(line, "/"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (r *sshRepository) Versions(ctx context.Context, name string) ([]string, error) {
+	packPath, err := r.remotePath(name)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("List archives", "path", packPath)
+
+	// list the package dir, archives of the package are selected by versionsFromFileNames
+	output, err := r.run(fmt.Sprintf("LC_ALL=C ls -1 %s", shellQuote(packPath)))
+	if err != nil {
+		err = remoteError("ls", name, err, output)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil // no archives
+		}
+		return nil, err
+	}
+
+	return versionsFromFileNames(name, strings.Split(strings.TrimSpace(string(output)), "\n")), nil
+}
+
+func (r *sshRepository) Fetch(ctx context.Context, p string, w io.Writer) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	return r.client.CopyFromRemotePassThru(ctx, w, remotePath, nil)
+}
+
+func (r *sshRepository) Upload(ctx context.Context, p string, rd io.Reader, size int64) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+
+	// Create remote directory
+	remoteDir := path.Dir(remotePath)
+	if output, err := r.run(fmt.Sprintf("mkdir -p %s", shellQuote(remoteDir))); err != nil {
+		return fmt.Errorf("can't create remote dir %s on server: %w: %s", remoteDir, err, output)
+	}
+
+	// copy to a temporary file and rename it, so readers never see a partial file
+	tmpPath := path.Join(remoteDir, ".upload-"+path.Base(remotePath))
+	if err := r.client.Copy(ctx, rd, tmpPath, "0655", size); err != nil {
+		return err
+	}
+	if output, err := r.run(fmt.Sprintf("mv -f %s %s", shellQuote(tmpPath), shellQuote(remotePath))); err != nil {
+		return fmt.Errorf("can't rename %s on server: %w: %s", tmpPath, err, output)
+	}
+	return nil
+}
+
+func (r *sshRepository) Delete(ctx context.Context, p string) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	if output, err := r.run(fmt.Sprintf("rm %s", shellQuote(remotePath))); err != nil {
+		return fmt.Errorf("can't delete %s on server: %w: %s", remotePath, err, output)
+	}
+	return nil
+}
+
+func (r *sshRepository) Lock(ctx context.Context, p string) error {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return err
+	}
+	// noclobber makes the redirection fail if the file exists
+	output, err := r.run(fmt.Sprintf("set -C && : > %s", shellQuote(remotePath)))
+	if err != nil {
+		// messages differ between shells, existing file is checked by stat
+		if _, serr := r.Stat(ctx, p); serr == nil {
+			return &fs.PathError{Op: "lock", Path: p, Err: fs.ErrExist}
+		}
+		return remoteError("lock", p, err, output)
+	}
+	return nil
+}
+
+func (r *sshRepository) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	remotePath, err := r.remotePath(p)
+	if err != nil {
+		return nil, err
+	}
+	output, err := r.run(fmt.Sprintf("LC_ALL=C stat -c '%%s %%Y' %s", shellQuote(remotePath)))
+	if err != nil {
+		return nil, remoteError("stat", p, err, output)
+	}
+
+	var size, mtime int64
+	if _, err := fmt.Sscan(string(output), &size, &mtime); err != nil {
+		return nil, fmt.Errorf("failed to parse stat output %q: %w", output, err)
+	}
+	return &remoteFileInfo{name: path.Base(p), size: size, modTime: time.Unix(mtime, 0)}, nil
+}
+
+// remoteError wraps the error of remote command into *fs.PathError. Only a missing file becomes fs.ErrNotExist,
+// failed connection, denied access and other errors are kept, so missing checksums and signatures are told apart.
+func remoteError(op, p string, err error, output []byte) error {
+	var exitErr *ssh.ExitError
+	msg := strings.TrimSpace(string(output))
+	switch {
+	case errors.As(err, &exitErr) && strings.Contains(msg, "No such file or directory"):
+		err = fs.ErrNotExist
+	case msg != "":
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	return &fs.PathError{Op: op, Path: p, Err: err}
+}
+
+// shellQuote quotes the argument of a remote command for POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (r *sshRepository) Close() error {
+	r.client.Close()
+	return r.sshClient.Close()
+}
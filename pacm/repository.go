@@ -0,0 +1,183 @@
+package pacm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Repository stores package archives.
+// Paths are slash separated and relative to the repository root,
+// archives are stored as <name>/<name>-<ver>.tar.gz
+type Repository interface {
+	// Packages lists names of packages, directories of the repository root
+	Packages(ctx context.Context) ([]string, error)
+	// Versions lists versions of the package archives
+	Versions(ctx context.Context, name string) ([]string, error)
+	// Fetch writes content of the file to w
+	Fetch(ctx context.Context, path string, w io.Writer) error
+	// Upload stores the file creating parent directories
+	Upload(ctx context.Context, path string, r io.Reader, size int64) error
+	Delete(ctx context.Context, path string) error
+	// Lock creates the empty file if it does not exist, otherwise fails with fs.ErrExist.
+	// The lock is released by Delete.
+	Lock(ctx context.Context, path string) error
+	Stat(ctx context.Context, path string) (fs.FileInfo, error)
+	Close() error
+}
+
+func archiveFileName(name, ver string) string {
+	return fmt.Sprintf("%s-%s.tar.gz", name, ver)
+}
+
+// deleteIfExists deletes the file of the repository, a missing file is not an error
+func deleteIfExists(ctx context.Context, repo Repository, p string) error {
+	if _, err := repo.Stat(ctx, p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return repo.Delete(ctx, p)
+}
+
+// path of the archive in the repository
+func archivePath(name, ver string) string {
+	return path.Join(name, archiveFileName(name, ver))
+}
+
+// check that repository path stays inside the repository root and has only [0-9A-Za-z._+-]
+// in its elements, so it is safe in remote commands
+func checkRepoPath(p string) error {
+	if !fs.ValidPath(p) {
+		return fmt.Errorf("invalid repository path %q", p)
+	}
+	for _, c := range p {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("._+-/", c)) {
+			return fmt.Errorf("invalid repository path %q: character %q is not allowed", p, c)
+		}
+	}
+	return nil
+}
+
+// validatePacket checks the package name and the version constraint of the requirement
+func validatePacket(p Packet) error {
+	if err := validatePackageName(p.Name); err != nil {
+		return err
+	}
+	if _, err := parseConstraint(p.Ver); err != nil {
+		return fmt.Errorf("invalid dependency %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// package name is a non empty string of [0-9A-Za-z._+-] which does not start with a dot or a dash,
+// so it is safe in repository paths and remote commands
+func validatePackageName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty package name")
+	}
+	if name[0] == '.' || name[0] == '-' {
+		return fmt.Errorf("invalid package name %q: must not start with %q", name, name[0])
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("._+-", c)) {
+			return fmt.Errorf("invalid package name %q: character %q is not allowed", name, c)
+		}
+	}
+	return nil
+}
+
+// versions of archives <name>-<ver>.tar.gz from the list of file names
+func versionsFromFileNames(name string, fileNames []string) []string {
+	var versions []string
+	for _, fileName := range fileNames {
+		fileName = path.Base(fileName)
+		if !strings.HasPrefix(fileName, name+"-") || !strings.HasSuffix(fileName, ".tar.gz") {
+			continue
+		}
+		ver, err := getVersionFromArchiveName(fileName, name)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, ver)
+	}
+	return versions
+}
+
+// OpenRepository opens the repository by URL:
+//
+//	file:///srv/packages         local directory
+//	ssh://user@host:22/packages  SSH server, files are copied by SCP
+//	sftp://user@host:22/packages SSH server, SFTP subsystem
+//	https://host/packages        read-only repository served by pm serve
+//
+// Empty URL means SSH server from PACMAN_SSH_* and PACMAN_ROOT_DIR environment variables,
+// PACMAN_SSH_TRANSPORT=sftp selects SFTP instead of SCP.
+func OpenRepository(repoURL string) (Repository, error) {
+	if repoURL == "" {
+		host, ok := os.LookupEnv("PACMAN_SSH_HOST")
+		if !ok {
+			host = "localhost"
+		}
+		port, ok := os.LookupEnv("PACMAN_SSH_PORT")
+		if !ok {
+			port = "22"
+		}
+		server := fmt.Sprintf("%s:%s", host, port)
+		newRepo := NewSSHRepository
+		if os.Getenv("PACMAN_SSH_TRANSPORT") == "sftp" {
+			newRepo = NewSFTPRepository
+		}
+		return newRepo(server, os.Getenv("PACMAN_SSH_USER"), os.Getenv("PACMAN_SSH_KEY"), os.Getenv("PACMAN_ROOT_DIR"))
+	}
+
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL %q: %w", repoURL, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFileRepository(u.Host + u.Path), nil
+	case "http", "https":
+		return NewHTTPRepository(repoURL)
+	case "ssh", "sftp":
+		port := u.Port()
+		if port == "" {
+			port = "22"
+		}
+		user := u.User.Username()
+		if user == "" {
+			user = os.Getenv("PACMAN_SSH_USER")
+		}
+		server := fmt.Sprintf("%s:%s", u.Hostname(), port)
+		if u.Scheme == "sftp" {
+			return NewSFTPRepository(server, user, os.Getenv("PACMAN_SSH_KEY"), u.Path)
+		}
+		return NewSSHRepository(server, user, os.Getenv("PACMAN_SSH_KEY"), u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported repository URL scheme %q", u.Scheme)
+	}
+}
+
+// remoteFileInfo describes a file of the remote repository
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *remoteFileInfo) Name() string       { return fi.name }
+func (fi *remoteFileInfo) Size() int64        { return fi.size }
+func (fi *remoteFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi *remoteFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *remoteFileInfo) IsDir() bool        { return false }
+func (fi *remoteFileInfo) Sys() any           { return nil }
@@ -0,0 +1,287 @@
+package pacm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// packetSource gives the solver available versions of packages and their dependencies
+type packetSource interface {
+	versions(ctx context.Context, name string) ([]string, error)
+	packets(ctx context.Context, name, ver string) ([]Packet, error)
+}
+
+// resolvedPacket is the single version of a package chosen for the whole dependency graph
+type resolvedPacket struct {
+	Name    string
+	Ver     string
+	Packets []Packet // dependencies from the manifest of the archive
+}
+
+// requirement is a version constraint of a package and who put it
+type requirement struct {
+	Ver string
+	By  string
+
+	constraint *Constraint
+}
+
+func (r requirement) describe(name string) string {
+	if r.Ver == "" {
+		return fmt.Sprintf("%s requires %s", r.By, name)
+	}
+	return fmt.Sprintf("%s requires %s %s", r.By, name, r.Ver)
+}
+
+// ConflictError reports requirements of a package that no available version satisfies
+type ConflictError struct {
+	Name         string
+	Requirements []requirement
+	Available    []string
+}
+
+func (e *ConflictError) Error() string {
+	reqs := make([]string, 0, len(e.Requirements))
+	for _, r := range e.Requirements {
+		reqs = append(reqs, r.describe(e.Name))
+	}
+	if len(e.Available) == 0 {
+		return fmt.Sprintf("no archives of package %s found (%s)", e.Name, strings.Join(reqs, ", "))
+	}
+	return fmt.Sprintf("version conflict for %s: %s (available: %s)",
+		e.Name, strings.Join(reqs, ", "), strings.Join(e.Available, ", "))
+}
+
+// solver chooses one version for every package of the dependency graph.
+// It tries the highest versions first and backtracks on conflicts.
+type solver struct {
+	src        packetSource
+	prerelease bool // allow pre-release versions to match ranges
+
+	versionsCache map[string][]string
+	packetsCache  map[string][]Packet
+
+	chosen  map[string]string
+	reqs    map[string][]requirement
+	pending []string // packages in order of the first requirement
+}
+
+func newSolver(src packetSource) *solver {
+	return &solver{
+		src:           src,
+		versionsCache: make(map[string][]string),
+		packetsCache:  make(map[string][]Packet),
+		chosen:        make(map[string]string),
+		reqs:          make(map[string][]requirement),
+	}
+}
+
+// resolve returns chosen packages ordered so that dependencies go before dependents
+func (s *solver) resolve(ctx context.Context, packages []Packet, by string) ([]*resolvedPacket, error) {
+	for _, pkg := range packages {
+		if err := s.require(pkg, by); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.solve(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.order(packages)
+}
+
+func (s *solver) require(pkg Packet, by string) error {
+	c, err := parseConstraint(pkg.Ver)
+	if err != nil {
+		return fmt.Errorf("%s requires %s: %w", by, pkg.Name, err)
+	}
+	if _, ok := s.reqs[pkg.Name]; !ok {
+		s.pending = append(s.pending, pkg.Name)
+	}
+	s.reqs[pkg.Name] = append(s.reqs[pkg.Name], requirement{Ver: pkg.Ver, By: by, constraint: c})
+	return nil
+}
+
+func (s *solver) solve(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("resolve canceled: %w", ctx.Err())
+	default:
+	}
+
+	name := ""
+	for _, n := range s.pending {
+		if _, ok := s.chosen[n]; !ok {
+			name = n
+			break
+		}
+	}
+	if name == "" {
+		return nil // all packages have a version
+	}
+
+	available, err := s.versions(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var candidates []string
+	for _, ver := range slices.Backward(available) {
+		if s.satisfies(name, ver) {
+			candidates = append(candidates, ver)
+		}
+	}
+	if len(candidates) == 0 {
+		return &ConflictError{Name: name, Requirements: slices.Clone(s.reqs[name]), Available: available}
+	}
+
+	var conflict error
+	for _, ver := range candidates {
+		deps, err := s.packets(ctx, name, ver)
+		if err != nil {
+			return err
+		}
+		slog.Debug("Try version", "package", name, "version", ver)
+
+		// save state for backtracking
+		pendingLen := len(s.pending)
+		reqsLen := make(map[string]int, len(deps))
+		for _, dep := range deps {
+			if _, ok := reqsLen[dep.Name]; !ok {
+				reqsLen[dep.Name] = len(s.reqs[dep.Name])
+			}
+		}
+
+		s.chosen[name] = ver
+		by := fmt.Sprintf("%s %s", name, ver)
+		for _, dep := range deps {
+			if err = s.require(dep, by); err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			err = s.checkChosen(deps)
+		}
+		if err == nil {
+			err = s.solve(ctx)
+		}
+		if err == nil {
+			return nil
+		}
+		var ce *ConflictError
+		if !errors.As(err, &ce) {
+			return err
+		}
+		if conflict == nil {
+			conflict = err
+		}
+
+		// backtrack
+		delete(s.chosen, name)
+		for dep, l := range reqsLen {
+			if l == 0 {
+				delete(s.reqs, dep)
+			} else {
+				s.reqs[dep] = s.reqs[dep][:l]
+			}
+		}
+		s.pending = s.pending[:pendingLen]
+	}
+	return conflict
+}
+
+// check new requirements against already chosen versions
+func (s *solver) checkChosen(deps []Packet) error {
+	for _, dep := range deps {
+		ver, ok := s.chosen[dep.Name]
+		if ok && !s.satisfies(dep.Name, ver) {
+			return &ConflictError{Name: dep.Name, Requirements: slices.Clone(s.reqs[dep.Name]), Available: s.versionsCache[dep.Name]}
+		}
+	}
+	return nil
+}
+
+func (s *solver) satisfies(name, ver string) bool {
+	v, err := parseVersion(ver)
+	if err != nil {
+		return false
+	}
+	for _, r := range s.reqs[name] {
+		if !r.constraint.Match(v, s.prerelease) {
+			return false
+		}
+	}
+	return true
+}
+
+// available versions sorted in ascending order
+func (s *solver) versions(ctx context.Context, name string) ([]string, error) {
+	if vers, ok := s.versionsCache[name]; ok {
+		return vers, nil
+	}
+	vers, err := s.src.versions(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions of %s: %w", name, err)
+	}
+	vers = slices.Clone(vers)
+	slices.SortFunc(vers, compareVersions)
+	s.versionsCache[name] = vers
+	return vers, nil
+}
+
+func (s *solver) packets(ctx context.Context, name, ver string) ([]Packet, error) {
+	key := name + "@" + ver
+	if deps, ok := s.packetsCache[key]; ok {
+		return deps, nil
+	}
+	deps, err := s.src.packets(ctx, name, ver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dependencies of %s %s: %w", name, ver, err)
+	}
+	s.packetsCache[key] = deps
+	return deps, nil
+}
+
+// order chosen packages from dependencies to dependents, dependency cycles are errors
+func (s *solver) order(packages []Packet) ([]*resolvedPacket, error) {
+	var (
+		res   []*resolvedPacket
+		done  = make(map[string]bool)
+		visit func(name string, path []string) error
+	)
+
+	visit = func(name string, path []string) error {
+		if i := slices.Index(path, name); i >= 0 {
+			cycle := append(slices.Clone(path[i:]), name)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+		if done[name] {
+			return nil
+		}
+
+		ver := s.chosen[name]
+		rp := &resolvedPacket{Name: name, Ver: ver, Packets: s.packetsCache[name+"@"+ver]}
+		next := append(slices.Clone(path), name)
+		for _, dep := range rp.Packets {
+			if err := visit(dep.Name, next); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		res = append(res, rp)
+		return nil
+	}
+
+	for _, pkg := range packages {
+		if err := visit(pkg.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,68 @@
+package pacm
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// RollbackOptions tune pm rollback
+type RollbackOptions struct {
+	To          string // version to restore, the previous one if empty
+	Generations int    // number of previous versions kept after rollback
+}
+
+// RollbackPackage reinstalls a previous version of the package from the local cache
+// without the repository. The rolled back version is kept as a generation.
+func RollbackPackage(dbPath, cacheDir, name string, opts RollbackOptions) error {
+	db, err := readInstalledDB(dbPath)
+	if err != nil {
+		return err
+	}
+	pkg := db.find(name)
+	if pkg == nil {
+		return fmt.Errorf("package %s is not installed", name)
+	}
+	gen := pkg.generation(opts.To)
+	if gen == nil {
+		if opts.To == "" {
+			return fmt.Errorf("no previous version of %s is kept", name)
+		}
+		return fmt.Errorf("version %s of %s is not kept", opts.To, name)
+	}
+
+	archive := cachedArchivePath(cacheDir, name, gen.Ver)
+	if err := verifyChecksum(archive, gen.SHA256); err != nil {
+		return fmt.Errorf("cached archive of %s %s: %w", name, gen.Ver, err)
+	}
+
+	// dependencies are not changed by rollback
+	for _, dep := range gen.Packets {
+		installed := db.find(dep.Name)
+		if installed == nil || !checkVersion(dep.Ver, installed.Ver) {
+			slog.Warn("Dependency of restored version is not satisfied", "package", name, "version", gen.Ver,
+				"dependency", dep.Name, "requires", dep.Ver)
+		}
+	}
+
+	sp, err := stagePackage(newExtractor(pkg.Root, 0), archive)
+	if err != nil {
+		return fmt.Errorf("package %s: %w", name, err)
+	}
+	tx := newTransaction()
+	tx.staging = append(tx.staging, sp.staging)
+
+	slog.Info("Roll back package", "package", name, "from", pkg.Ver, "to", gen.Ver)
+	restored := InstalledPackage{
+		Name:     name,
+		Ver:      gen.Ver,
+		Archive:  gen.Archive,
+		SHA256:   gen.SHA256,
+		Packets:  gen.Packets,
+		Explicit: pkg.Explicit,
+	}
+	if err := applyPackages(tx, db, dbPath, []InstalledPackage{restored}, []*stagedPackage{sp}, opts.Generations); err != nil {
+		return fmt.Errorf("failed to roll back %s: %w", name, err)
+	}
+	pruneCache(cacheDir, db.find(name))
+	return nil
+}
@@ -0,0 +1,161 @@
+package pacm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// scanIndex builds index of the repository directory <root>/<name>/<name>-<ver>.tar.gz
+func scanIndex(ctx context.Context, root string) (*RepoIndex, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository dir: %w", err)
+	}
+
+	repo := NewFileRepository(root)
+	index := &RepoIndex{Packages: make(map[string]*IndexPackage)}
+	for _, e := range entries {
+		if !e.IsDir() || validatePackageName(e.Name()) != nil {
+			continue
+		}
+		name := e.Name()
+		versions, err := repo.Versions(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		slices.SortFunc(versions, compareVersions)
+
+		pkg := &IndexPackage{}
+		for _, ver := range versions {
+			info, err := repo.Stat(ctx, archivePath(name, ver))
+			if err != nil {
+				return nil, err
+			}
+			pkg.Versions = append(pkg.Versions, IndexVersion{
+				Ver:     ver,
+				Archive: archivePath(name, ver),
+				Size:    info.Size(),
+			})
+		}
+		index.Packages[name] = pkg
+	}
+	return index, nil
+}
+
+// Serve exposes the repository directory over HTTP until ctx is done:
+// GET /index.json returns RepoIndex, GET /<name>/<name>-<ver>.tar.gz returns the archive
+// (range requests are supported).
+func Serve(ctx context.Context, addr, root string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: newServeHandler(root),
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serve repository", "addr", addr, "root", root)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func newServeHandler(root string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		p := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		lg := slog.With("path", p, "remote", r.RemoteAddr)
+		lg.Debug("Serve request")
+
+		// index.json is maintained by pm create, repositories without it are scanned
+		if p == indexFileName && !fileExists(filepath.Join(root, indexFileName)) {
+			index, err := scanIndex(r.Context(), root)
+			if err != nil {
+				lg.Error("failed to build index", "error", err)
+				http.Error(w, "failed to build index", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(index)
+			return
+		}
+
+		if !servedPath(p) {
+			lg.Debug("Refuse request outside of the repository layout")
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
+
+// only index.json and <name>/<name>-<ver>.tar.gz with .sha256 and .sig sidecars are served,
+// other files of the repository dir (e.g. .ssh of the home dir) are never exposed
+func servedPath(p string) bool {
+	if p == indexFileName {
+		return true
+	}
+	if checkRepoPath(p) != nil {
+		return false
+	}
+	for seg := range strings.SplitSeq(p, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return false
+		}
+	}
+	name, file, ok := strings.Cut(p, "/")
+	if !ok || strings.Contains(file, "/") || validatePackageName(name) != nil {
+		return false
+	}
+	for _, sidecar := range []string{checksumPath(""), signaturePath("")} {
+		if trimmed, ok := strings.CutSuffix(file, sidecar); ok {
+			file = trimmed
+			break
+		}
+	}
+	if !strings.HasPrefix(file, name+"-") || !strings.HasSuffix(file, ".tar.gz") {
+		return false
+	}
+	_, err := getVersionFromArchiveName(file, name)
+	return err == nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
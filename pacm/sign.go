@@ -0,0 +1,141 @@
+package pacm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUnsigned is returned for packages without signature when signatures are required
+var ErrUnsigned = errors.New("package is not signed")
+
+// PackageSignature is published next to the archive as <archive>.sig.
+// It signs name, version and sha256 of the archive, the manifest is inside the archive.
+type PackageSignature struct {
+	PublicKey string `json:"public_key"` // authorized_keys format
+	Format    string `json:"format"`
+	Blob      []byte `json:"blob"`
+}
+
+// SignaturePolicy tells pm update which publishers are trusted
+type SignaturePolicy struct {
+	TrustedKeys []ssh.PublicKey
+	Require     bool // refuse unsigned packages and packages signed by untrusted keys
+}
+
+func signaturePath(archivePath string) string {
+	return archivePath + ".sig"
+}
+
+// signed message binds the archive content to the package name and version
+func signedMessage(name, ver, sum string) []byte {
+	return fmt.Appendf(nil, "pacman-signature-v1\n%s\n%s\n%s\n", name, ver, sum)
+}
+
+func signPackage(signer ssh.Signer, name, ver, sum string) (*PackageSignature, error) {
+	sig, err := signer.Sign(rand.Reader, signedMessage(name, ver, sum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign package: %w", err)
+	}
+	return &PackageSignature{
+		PublicKey: string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Format:    sig.Format,
+		Blob:      sig.Blob,
+	}, nil
+}
+
+func publishSignature(ctx context.Context, repo Repository, archivePath string, sig *PackageSignature) error {
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signature: %w", err)
+	}
+	if err := repo.Upload(ctx, signaturePath(archivePath), bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to upload signature: %w", err)
+	}
+	return nil
+}
+
+// download signature of the archive, nil if the archive is not signed
+func fetchSignature(ctx context.Context, repo Repository, archivePath string) (*PackageSignature, error) {
+	p := signaturePath(archivePath)
+	if _, err := repo.Stat(ctx, p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to stat signature: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := repo.Fetch(ctx, p, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download signature: %w", err)
+	}
+	var sig PackageSignature
+	if err := json.Unmarshal(buf.Bytes(), &sig); err != nil {
+		return nil, fmt.Errorf("failed to parse signature %s: %w", p, err)
+	}
+	return &sig, nil
+}
+
+// verify checks the signature of the package archive by the policy.
+// A bad signature is always an error, unsigned and untrusted packages are errors if signatures are required.
+func (sp *SignaturePolicy) verify(sig *PackageSignature, name, ver, sum string) error {
+	lg := slog.With("package", name, "version", ver)
+	if sig == nil {
+		if sp.Require {
+			return fmt.Errorf("%s %s: %w", name, ver, ErrUnsigned)
+		}
+		lg.Debug("Package is not signed")
+		return nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sig.PublicKey))
+	if err != nil {
+		return fmt.Errorf("%s %s: invalid signature key: %w", name, ver, err)
+	}
+	err = key.Verify(signedMessage(name, ver, sum), &ssh.Signature{Format: sig.Format, Blob: sig.Blob})
+	if err != nil {
+		return fmt.Errorf("%s %s: bad signature: %w", name, ver, err)
+	}
+
+	for _, trusted := range sp.TrustedKeys {
+		if bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			lg.Debug("Package signature is verified", "key", ssh.FingerprintSHA256(key))
+			return nil
+		}
+	}
+	if sp.Require {
+		return fmt.Errorf("%s %s: signed by untrusted key %s", name, ver, ssh.FingerprintSHA256(key))
+	}
+	lg.Warn("Package is signed by untrusted key", "key", ssh.FingerprintSHA256(key))
+	return nil
+}
+
+// LoadTrustedKeys reads public keys of trusted publishers in authorized_keys format
+func LoadTrustedKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+
+	var keys []ssh.PublicKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted key %s:%d: %w", path, i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,289 @@
+package pacm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// transaction applies packages unpacked to staging dirs to their install dirs.
+// Every file is moved in place by rename, replaced and removed files are kept in backup dirs
+// until commit, so all changes of the transaction can be undone by rollback.
+type transaction struct {
+	journal []txnOp
+	backups map[string]string // backup dir by install dir
+	nbackup int               // backups are numbered, one path may be backed up several times
+	staging []string
+}
+
+// txnOp is an applied change and what rollback does with it
+type txnOp struct {
+	kind   string // placed, replaced, removed, mkdir or chmod
+	path   string
+	backup string      // old file for replaced and removed
+	mode   os.FileMode // old mode for chmod
+}
+
+// stagedPackage is a package unpacked to the staging dir inside its install dir
+type stagedPackage struct {
+	dir     string // absolute install dir
+	staging string
+	files   []InstalledFile
+}
+
+func newTransaction() *transaction {
+	return &transaction{backups: make(map[string]string)}
+}
+
+// stagePackage unpacks the archive to a new staging dir inside the install dir,
+// the same file system allows to move files in place by rename
+func stagePackage(ext *extractor, archivePath string) (*stagedPackage, error) {
+	dir, err := filepath.Abs(ext.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve install dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create install dir: %w", err)
+	}
+	staging, err := os.MkdirTemp(dir, ".pacman-stage-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+
+	stageExt := *ext
+	stageExt.root = staging
+	files, err := stageExt.extract(archivePath)
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, err
+	}
+	return &stagedPackage{dir: dir, staging: staging, files: files}, nil
+}
+
+// install moves staged files of the package to the install dir
+func (tx *transaction) install(sp *stagedPackage) error {
+	root, err := filepath.EvalSymlinks(sp.dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve install dir: %w", err)
+	}
+
+	seen := make(map[string]bool, len(sp.files))
+	for _, f := range sp.files {
+		if seen[f.Path] {
+			continue // entry repeated in archive is staged once
+		}
+		seen[f.Path] = true
+		src := filepath.Join(sp.staging, filepath.FromSlash(f.Path))
+		dst := filepath.Join(root, filepath.FromSlash(f.Path))
+		if err := checkInRoot(root, filepath.Dir(dst)); err != nil {
+			return err
+		}
+		if err := tx.mkdirAll(root, filepath.Dir(dst)); err != nil {
+			return err
+		}
+
+		if f.Type == fileTypeDir {
+			if err := tx.placeDir(root, dst, f.Mode); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := os.Lstat(dst)
+		switch {
+		case err == nil && info.IsDir():
+			return fmt.Errorf("failed to install %s: directory exists", dst)
+		case err == nil:
+			backup, err := tx.backup(root, dst)
+			if err != nil {
+				return err
+			}
+			tx.journal = append(tx.journal, txnOp{kind: "replaced", path: dst, backup: backup})
+		case errors.Is(err, os.ErrNotExist):
+			tx.journal = append(tx.journal, txnOp{kind: "placed", path: dst})
+		default:
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("failed to install %s: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+// remove moves the installed file to the backup dir
+func (tx *transaction) remove(root, path string) error {
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	backup, err := tx.backup(root, path)
+	if err != nil {
+		return err
+	}
+	tx.journal = append(tx.journal, txnOp{kind: "removed", path: path, backup: backup})
+	return nil
+}
+
+// backup moves the file to the backup dir of the install root under a new name,
+// the same path replaced by several packages keeps every old version for rollback
+func (tx *transaction) backup(root, path string) (string, error) {
+	dir, ok := tx.backups[root]
+	if !ok {
+		var err error
+		if dir, err = os.MkdirTemp(root, ".pacman-backup-"); err != nil {
+			return "", fmt.Errorf("failed to create backup dir: %w", err)
+		}
+		tx.backups[root] = dir
+	}
+
+	tx.nbackup++
+	backup := filepath.Join(dir, strconv.Itoa(tx.nbackup))
+	if err := os.Rename(path, backup); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	return backup, nil
+}
+
+// mkdirAll creates missing directories inside the root one by one to undo them
+func (tx *transaction) mkdirAll(root, dir string) error {
+	if dir == root {
+		return nil
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		return nil
+	}
+	if err := tx.mkdirAll(root, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tx.journal = append(tx.journal, txnOp{kind: "mkdir", path: dir})
+	return nil
+}
+
+func (tx *transaction) placeDir(root, dir string, mode os.FileMode) error {
+	info, err := os.Lstat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := tx.mkdirAll(root, dir); err != nil {
+			return err
+		}
+		return os.Chmod(dir, mode)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("failed to install %s: not a directory", dir)
+	}
+	if old := fileMode(info); old != mode {
+		if err := os.Chmod(dir, mode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", dir, err)
+		}
+		tx.journal = append(tx.journal, txnOp{kind: "chmod", path: dir, mode: old})
+	}
+	return nil
+}
+
+// rollback undoes all changes in reverse order
+func (tx *transaction) rollback() error {
+	var errs []error
+	for _, op := range slices.Backward(tx.journal) {
+		var err error
+		switch op.kind {
+		case "placed":
+			err = os.Remove(op.path)
+		case "replaced":
+			if err = os.Remove(op.path); err == nil || errors.Is(err, os.ErrNotExist) {
+				err = os.Rename(op.backup, op.path)
+			}
+		case "removed":
+			err = os.Rename(op.backup, op.path)
+		case "mkdir":
+			err = os.Remove(op.path)
+		case "chmod":
+			err = os.Chmod(op.path, op.mode)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("failed to roll back", "op", op.kind, "path", op.path, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	tx.journal = nil
+	tx.cleanup()
+	return errors.Join(errs...)
+}
+
+// commit drops backups of replaced and removed files
+func (tx *transaction) commit() {
+	tx.journal = nil
+	tx.cleanup()
+}
+
+func (tx *transaction) cleanup() {
+	for _, dir := range tx.staging {
+		os.RemoveAll(dir)
+	}
+	for _, dir := range tx.backups {
+		os.RemoveAll(dir)
+	}
+	tx.staging = nil
+	tx.backups = make(map[string]string)
+}
+
+// applyPackages installs staged packages in the transaction and writes the database,
+// files of previous versions which are not in the new ones are removed.
+// On error all changes are rolled back and the database file is not changed.
+func applyPackages(tx *transaction, db *InstalledDB, dbPath string, pkgs []InstalledPackage, staged []*stagedPackage, generations int) error {
+	previous := make(map[string]InstalledPackage)
+	for _, pkg := range pkgs {
+		if installed := db.find(pkg.Name); installed != nil {
+			previous[pkg.Name] = *installed
+		}
+	}
+
+	var staleDirs []string
+	err := func() error {
+		for i, pkg := range pkgs {
+			slog.Info("Install package", "package", pkg.Name, "version", pkg.Ver, "dir", staged[i].dir)
+			if err := tx.install(staged[i]); err != nil {
+				return fmt.Errorf("package %s: %w", pkg.Name, err)
+			}
+			pkg.Root = staged[i].dir
+			pkg.Files = staged[i].files
+			pkg.Installed = time.Now().UTC()
+			db.upgrade(pkg, generations)
+		}
+
+		// files of old versions which are not in the new ones
+		owned := db.ownedFiles(nil)
+		for name, old := range previous {
+			files, dirs := unownedFiles(&old, owned)
+			for _, p := range files {
+				if err := tx.remove(old.Root, p); err != nil {
+					return fmt.Errorf("package %s: failed to remove stale file: %w", name, err)
+				}
+			}
+			staleDirs = append(staleDirs, dirs...)
+		}
+
+		return db.write(dbPath)
+	}()
+	if err != nil {
+		if rbErr := tx.rollback(); rbErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to roll back: %w", rbErr))
+		}
+		return err
+	}
+
+	tx.commit()
+	if err := removeEmptyDirs(staleDirs); err != nil {
+		slog.Warn("Failed to remove empty directories", "error", err)
+	}
+	return nil
+}
@@ -1,37 +1,44 @@
 package pacm
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"slices"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	scp "github.com/bramvdbogaerde/go-scp"
-	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
-func (pm *PackageManager) UpdatePackages(ctx context.Context, configPath string) error {
+// UpdateOptions tune pm update
+type UpdateOptions struct {
+	Prerelease bool   // allow pre-release versions to match version ranges
+	Locked     bool   // install exactly what the lockfile says
+	Prefix     string // install root, current directory if empty
+	Force      bool   // reinstall packages which are up to date
+	Signature  SignaturePolicy
+	MaxSize    int64 // limit of decompressed size of one archive, default 1 GiB
+	SameOwner  bool  // restore owner of files from the archive when running as root
+}
+
+func (pm *PackageManager) UpdatePackages(ctx context.Context, configPath string, opts UpdateOptions) error {
 
-	var wg sync.WaitGroup
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
 
 	startTime := time.Now()
 	defer func() {
 		slog.Info("Finish update packages", "time", time.Since(startTime))
 	}()
 
-	defer wg.Wait()
-
 	slog.Info("Start update packages...")
 
 	select {
@@ -40,218 +47,389 @@ func (pm *PackageManager) UpdatePackages(ctx context.Context, configPath string)
 	default:
 	}
 
-	configData, err := os.ReadFile(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to read config: %w", err)
+	if opts.Signature.Require && len(opts.Signature.TrustedKeys) == 0 {
+		return fmt.Errorf("signatures are required, but no trusted keys are configured")
 	}
 
-	var config PackagesConfig
-	if strings.HasSuffix(configPath, ".yaml") || strings.HasSuffix(configPath, ".yml") {
-		err = yaml.Unmarshal(configData, &config)
-	} else {
-		err = json.Unmarshal(configData, &config)
+	src := newRepoSource(pm.repo)
+	src.signature = opts.Signature
+	defer src.close()
+
+	// resolve the whole dependency graph before unpacking anything
+	config, lock, packets, err := resolveUpdate(ctx, src, configPath, opts)
+	if err != nil {
+		return err
 	}
+	lockPath := lockfilePath(configPath)
+
+	db, err := readInstalledDB(pm.db)
 	if err != nil {
-		return fmt.Errorf("failed to parse config: %w", err)
+		return err
 	}
 
+	dests := make(map[string]string, len(config.Packages))
+	explicit := make(map[string]bool, len(config.Packages))
 	for _, pkg := range config.Packages {
-		wg.Add(1)
+		dests[pkg.Name] = pkg.Dest
+		explicit[pkg.Name] = true
+	}
 
-		go func(pkg Packet) {
-			defer wg.Done()
-			lg := slog.With("package", pkg.Name, "version", pkg.Ver)
-			sshClient, err := ssh.Dial("tcp", pm.server, pm.sshConfig)
-			if err != nil {
-				lg.Error("failed to connect to SSH server", "error", err)
-				return
-			}
-			defer sshClient.Close()
+	newLock := &Lockfile{}
+	var (
+		install  []*resolvedPacket
+		archives []string
+		sums     []string
+	)
+	for _, rp := range packets {
+		dir, err := filepath.Abs(installDir(opts.Prefix, dests[rp.Name]))
+		if err != nil {
+			return fmt.Errorf("package %s: %w", rp.Name, err)
+		}
+		installed := db.find(rp.Name)
+		if installed != nil && installed.Explicit {
+			explicit[rp.Name] = true
+		}
 
-			// Create a new SCP client, note that this function might
-			// return an error, as a new SSH session is established using the existing connecton
+		// installed package of the same version is not downloaded again
+		if !opts.Force && installed.upToDate(rp.Ver, dir, lock) {
+			slog.Info("Package is up to date", "package", rp.Name, "version", rp.Ver)
+			installed.Explicit = explicit[rp.Name]
+			newLock.Packages = append(newLock.Packages, LockedPacket{
+				Name:    rp.Name,
+				Ver:     rp.Ver,
+				Archive: installed.Archive,
+				SHA256:  installed.SHA256,
+			})
+			continue
+		}
 
-			client, err := scp.NewClientBySSH(sshClient)
-			if err != nil {
-				lg.Error("Error creating new SSH session from existing connection", "error", err)
-				return
+		archiveName, err := src.fetch(ctx, rp.Name, rp.Ver)
+		if err != nil {
+			return fmt.Errorf("package %s: %w", rp.Name, err)
+		}
+		sum, err := fileSHA256(archiveName)
+		if err != nil {
+			return fmt.Errorf("package %s: %w", rp.Name, err)
+		}
+		if opts.Locked {
+			if want := lock.find(rp.Name).SHA256; sum != want {
+				os.Remove(archiveName)
+				return fmt.Errorf("package %s %s: checksum mismatch: lockfile %s, downloaded %s", rp.Name, rp.Ver, want, sum)
 			}
-			defer client.Close()
+		}
+		newLock.Packages = append(newLock.Packages, LockedPacket{
+			Name:    rp.Name,
+			Ver:     rp.Ver,
+			Archive: filepath.Base(archiveName),
+			SHA256:  sum,
+		})
+		install = append(install, rp)
+		archives = append(archives, archiveName)
+		sums = append(sums, sum)
+	}
 
-			lg.Info("Update package", "name", pkg.Name, "version", pkg.Ver)
+	// packages are unpacked to staging dirs first, nothing is installed if any of them fails
+	staged := make([]*stagedPackage, len(install))
+	for i, rp := range install {
+		wg.Add(1)
 
-			// Get archive name
-			packPath := fmt.Sprintf("%s/%s", os.Getenv("PACMAN_ROOT_DIR"), pkg.Name)
-			archiveName, err := getArchiveName(ctx, lg, sshClient, packPath, pkg.Name, pkg.Ver) //
+		go func(i int, rp *resolvedPacket, archiveName string) {
+			defer wg.Done()
+			dir := installDir(opts.Prefix, dests[rp.Name])
+			lg := slog.With("package", rp.Name, "version", rp.Ver)
+			lg.Info("Unpack package", "archive", archiveName, "dir", dir)
+
+			ext := newExtractor(dir, opts.MaxSize)
+			ext.owner = opts.SameOwner
+			sp, err := stagePackage(ext, archiveName)
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				lg.Error("Skip packet. Failed to get archive name", "packet", pkg.Name, "error", err)
+				lg.Error("failed to unpack archive", "error", err)
+				errs = append(errs, fmt.Errorf("package %s: %w", rp.Name, err))
 				return
 			}
-			remotePath := fmt.Sprintf("%s/%s", packPath, archiveName)
+			staged[i] = sp
+		}(i, rp, archives[i])
+	}
+	wg.Wait()
 
-			archiveFile, err := os.Create(archiveName)
-			if err != nil {
-				lg.Error("failed to create local archive", "error", err)
-				return
-			}
-			defer archiveFile.Close()
-			err = client.CopyFromRemote(ctx, archiveFile, remotePath)
-			if err != nil {
-				archiveFile.Close()
-				lg.Error("failed to download archive from server", "error", err)
-				return
-			}
+	// the whole update is one transaction, the database is written only if all packages are installed
+	tx := newTransaction()
+	for _, sp := range staged {
+		if sp != nil {
+			tx.staging = append(tx.staging, sp.staging)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		tx.rollback()
+		return fmt.Errorf("failed to update packages: %w", err)
+	}
 
-			archiveFile, err = os.Open(archiveName)
-			if err != nil {
-				lg.Error("failed to open archive", "error", err)
-				return
-			}
-			defer archiveFile.Close()
+	pkgs := make([]InstalledPackage, len(install))
+	for i, rp := range install {
+		pkgs[i] = InstalledPackage{
+			Name:     rp.Name,
+			Ver:      rp.Ver,
+			Archive:  filepath.Base(archives[i]),
+			SHA256:   sums[i],
+			Packets:  rp.Packets,
+			Explicit: explicit[rp.Name],
+		}
+	}
+	// archives are kept in the cache for pm rollback, nothing is installed if they can't be cached
+	for i, pkg := range pkgs {
+		if err := cacheArchive(pm.cache, pkg.Name, pkg.Ver, archives[i]); err != nil {
+			tx.rollback()
+			return fmt.Errorf("failed to update packages: package %s: %w", pkg.Name, err)
+		}
+	}
+	if err := applyPackages(tx, db, pm.db, pkgs, staged, pm.generations); err != nil {
+		return fmt.Errorf("failed to update packages: %w", err)
+	}
+	for _, pkg := range pkgs {
+		pruneCache(pm.cache, db.find(pkg.Name))
+	}
 
-			gr, err := gzip.NewReader(archiveFile)
-			if err != nil {
-				lg.Error("failed to create gzip reader", "error", err)
-				return
-			}
-			defer gr.Close()
-
-			tr := tar.NewReader(gr)
-			for {
-				header, err := tr.Next()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					lg.Error("failed to read tar", "error", err)
-					return
-				}
-
-				outPath := header.Name
-				if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
-					lg.Error("failed to create directories", "error", err)
-					return
-				}
-
-				outFile, err := os.Create(outPath)
-				if err != nil {
-					lg.Error("failed to create output file", "error", err)
-					return
-				}
-				_, err = io.Copy(outFile, tr)
-				outFile.Close()
-				if err != nil {
-					lg.Error("failed to write output file", "error", err)
-					return
-				}
-			}
-			// TO DO: dependency check
-			// - Read the metadata file
-			// - prepare dependency in packets section by recursive call UpdatePackages
-		}(pkg)
+	if !opts.Locked {
+		if err := newLock.write(lockPath); err != nil {
+			return err
+		}
+		slog.Info("Write lockfile", "path", lockPath)
 	}
 
 	return nil
 }
 
-func getArchiveName(ctx context.Context, log *slog.Logger, sshClient *ssh.Client, packPath, packName, ver string) (archName string, err error) {
-	slog.Debug("Get archive name", "path", packPath, "ver", ver)
+// resolveUpdate reads the packages config and chooses versions of all packages,
+// with opts.Locked versions are taken from the lockfile which is returned too
+func resolveUpdate(ctx context.Context, src *repoSource, configPath string, opts UpdateOptions) (*PackagesConfig, *Lockfile, []*resolvedPacket, error) {
+	config, err := readPackagesConfig(configPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if opts.Locked {
+		lockPath := lockfilePath(configPath)
+		lock, err := readLockfile(lockPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := lock.check(*config, opts.Prerelease); err != nil {
+			return nil, nil, nil, fmt.Errorf("lockfile %s is out of date: %w", lockPath, err)
+		}
+		packets, err := lock.packets(ctx, src)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return config, lock, packets, nil
+	}
+
+	slv := newSolver(src)
+	slv.prerelease = opts.Prerelease
+	packets, err := slv.resolve(ctx, config.Packages, configPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to resolve dependencies: %w", err)
+	}
+	return config, nil, packets, nil
+}
+
+// read packages.json or packages.yaml
+func readPackagesConfig(configPath string) (*PackagesConfig, error) {
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
 
-	session, err := sshClient.NewSession()
+	var config PackagesConfig
+	if strings.HasSuffix(configPath, ".yaml") || strings.HasSuffix(configPath, ".yml") {
+		err = yaml.Unmarshal(configData, &config)
+	} else {
+		err = json.Unmarshal(configData, &config)
+	}
 	if err != nil {
-		log.Error("Failed to create SSH session", "error", err)
-		return
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	for _, p := range config.Packages {
+		if err := validatePacket(p); err != nil {
+			return nil, fmt.Errorf("config %s: %w", configPath, err)
+		}
 	}
-	defer session.Close()
+	return &config, nil
+}
 
-	// Use a command to list the archive files in the package path
-	cmd := fmt.Sprintf("ls %s/%s*.tar.gz", packPath, packName)
-	output, err := session.CombinedOutput(cmd)
+// install dir of the package: dest relative to the prefix or absolute dest,
+// dependencies without dest are installed to the prefix
+func installDir(prefix, dest string) string {
+	if prefix == "" {
+		prefix = "."
+	}
+	if filepath.IsAbs(dest) {
+		return dest
+	}
+	return filepath.Join(prefix, dest)
+}
+
+// download archive from the repository to the local file
+func downloadArchive(ctx context.Context, repo Repository, name, ver, localPath string) error {
+	archiveFile, err := os.Create(localPath)
 	if err != nil {
-		log.Error("Failed to execute command", "cmd", cmd, "error", err, "output", string(output))
-		return
+		return fmt.Errorf("failed to create local archive: %w", err)
 	}
+	defer archiveFile.Close()
 
-	archNames := strings.TrimSpace(string(output))
-	if archNames == "" {
-		err = fmt.Errorf("no archive found for package %s version %s", packName, ver)
-		log.Error("No archive found", "error", err)
-		return
+	err = repo.Fetch(ctx, archivePath(name, ver), archiveFile)
+	if err != nil {
+		archiveFile.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("failed to download archive from repository: %w", err)
 	}
+	return nil
+}
 
-	// Split the output to get the archive name
-	archNamesSlice := strings.Split(archNames, "\n")
+// repoSource lists and downloads archives from the repository.
+// Versions and dependencies are taken from the repository index if it has the package,
+// otherwise archives are listed and dependencies are read from downloaded archives.
+type repoSource struct {
+	repo      Repository
+	signature SignaturePolicy
+	archives  map[string]string // downloaded archives by name@ver
+	dir       string            // temp dir of downloaded archives, removed by close
+	stream    bool              // read dependencies from streamed archives, nothing is saved
+	maxSize   int64             // unpack limit of streamed archives, defaultMaxUnpackSize if 0
+	scanned   map[string]*archiveContent
+
+	indexLoaded bool
+	index       *RepoIndex
+}
 
-	slices.SortFunc(archNamesSlice, func(a, b string) int {
-		v1, _ := getVersionFromArchiveName(a, packName)
-		v2, _ := getVersionFromArchiveName(b, packName)
-		return compareVersions(v1, v2)
-	})
-	log.Debug("Sorted archive names", "names", archNamesSlice)
-	//archName = filepath.Base(archNamesSlice[len(archNamesSlice)-1])
+func newRepoSource(repo Repository) *repoSource {
+	return &repoSource{
+		repo:     repo,
+		archives: make(map[string]string),
+		scanned:  make(map[string]*archiveContent),
+	}
+}
 
-	// check version
-	found := false
-	for _, arch := range archNamesSlice {
-		arch = filepath.Base(arch)
-		actualVer, err := getVersionFromArchiveName(arch, packName)
+// index is downloaded once, nil if the repository has no index
+func (src *repoSource) getIndex(ctx context.Context) *RepoIndex {
+	if !src.indexLoaded {
+		src.indexLoaded = true
+		index, err := readIndex(ctx, src.repo)
 		if err != nil {
-			err = fmt.Errorf("archive name %s does not contain valid version: %w", arch, err)
-			log.Error("Archive name does not contain valid version", "name", arch, "error", err)
-			archName = ""
-			continue
+			slog.Warn("Repository index is not available, list archives", "error", err)
 		}
-		if checkVersion(ver, actualVer) {
-			archName = arch
-			found = true
-			log.Debug("Found matching archive name", "name", archName, "version", ver)
-		} else {
-			log.Debug("Archive name does not match version", "name", arch, "version", ver)
-			if found {
-				// If we already found a matching archive, we can stop checking further
-				break
+		src.index = index
+	}
+	return src.index
+}
+
+func (src *repoSource) versions(ctx context.Context, name string) ([]string, error) {
+	if index := src.getIndex(ctx); index != nil {
+		if pkg, ok := index.Packages[name]; ok {
+			versions := make([]string, 0, len(pkg.Versions))
+			for _, v := range pkg.Versions {
+				versions = append(versions, v.Ver)
 			}
+			return versions, nil
 		}
 	}
-	return
+	return src.repo.Versions(ctx, name)
 }
 
-func compareVersions(v1, v2 string) int {
-	v1Parts := strings.Split(v1, ".")
-	v2Parts := strings.Split(v2, ".")
-
-	maxLen := len(v1Parts)
-	if len(v2Parts) > maxLen {
-		maxLen = len(v2Parts)
+func (src *repoSource) packets(ctx context.Context, name, ver string) ([]Packet, error) {
+	if index := src.getIndex(ctx); index != nil {
+		if v := index.find(name, ver); v != nil {
+			return v.Packets, nil
+		}
 	}
 
-	for i := 0; i < maxLen; i++ {
-		var (
-			p1, p2 int
-			err    error
-		)
-		if i < len(v1Parts) && v1Parts[i] != "" {
-			p1, err = strconv.Atoi(v1Parts[i])
-			if err != nil {
-				slog.Warn("compareVersions: can't parse str to int", "string", v1Parts[i], "error", err)
-				p1 = 0
-			}
-		}
-		if i < len(v2Parts) && v2Parts[i] != "" {
-			p2, err = strconv.Atoi(v2Parts[i])
-			if err != nil {
-				slog.Warn("compareVersions: can't parse str to int", "string", v2Parts[i], "error", err)
-				p2 = 0
-			}
+	if src.stream {
+		content, err := src.scan(ctx, name, ver)
+		if err != nil {
+			return nil, err
 		}
-		if p1 < p2 {
-			return -1
+		return content.manifest.Packets, nil
+	}
+
+	// dependencies are read from the manifest of the downloaded archive
+	archiveName, err := src.fetch(ctx, name, ver)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readManifest(archiveName, name, ver)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Packets, nil
+}
+
+// download archive of the package version once to the temp dir, return local path
+func (src *repoSource) fetch(ctx context.Context, name, ver string) (string, error) {
+	key := name + "@" + ver
+	if archiveName, ok := src.archives[key]; ok {
+		return archiveName, nil
+	}
+
+	if src.dir == "" {
+		dir, err := os.MkdirTemp("", "pacman-download-*")
+		if err != nil {
+			return "", fmt.Errorf("failed to create download dir: %w", err)
 		}
-		if p1 > p2 {
-			return 1
+		src.dir = dir
+	}
+	archiveName := filepath.Join(src.dir, archiveFileName(name, ver))
+	if err := downloadArchive(ctx, src.repo, name, ver, archiveName); err != nil {
+		return "", err
+	}
+
+	// verify checksum and signature before the archive is read
+	if err := src.verify(ctx, name, ver, archiveName); err != nil {
+		os.Remove(archiveName)
+		return "", err
+	}
+
+	src.archives[key] = archiveName
+	return archiveName, nil
+}
+
+// close removes downloaded archives, installed ones are kept in the cache
+func (src *repoSource) close() {
+	if src.dir != "" {
+		os.RemoveAll(src.dir)
+	}
+}
+
+func (src *repoSource) verify(ctx context.Context, name, ver, archiveName string) error {
+	want, err := src.checksum(ctx, name, ver)
+	if err != nil {
+		return err
+	}
+	if want == "" {
+		slog.Warn("Archive has no published checksum", "package", name, "version", ver)
+	} else if err := verifyChecksum(archiveName, want); err != nil {
+		return err
+	}
+
+	sig, err := fetchSignature(ctx, src.repo, archivePath(name, ver))
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(archiveName)
+	if err != nil {
+		return err
+	}
+	return src.signature.verify(sig, name, ver, sum)
+}
+
+// published checksum of the archive from the index or from the .sha256 file
+func (src *repoSource) checksum(ctx context.Context, name, ver string) (string, error) {
+	if index := src.getIndex(ctx); index != nil {
+		if v := index.find(name, ver); v != nil && v.SHA256 != "" {
+			return v.SHA256, nil
 		}
 	}
-	return 0
+	return fetchChecksum(ctx, src.repo, archivePath(name, ver))
 }
 
 func getVersionFromArchiveName(archiveName, packName string) (string, error) {
@@ -262,46 +440,8 @@ func getVersionFromArchiveName(archiveName, packName string) (string, error) {
 	if version == "" {
 		return "", fmt.Errorf("archive name %s does not contain version", archiveName)
 	}
-	return version, nil
-}
-
-func checkVersion(requiredVer, actualVer string) bool {
-	if requiredVer == "" {
-		return true // no need version check
-	}
-
-	// equal version
-	if !strings.HasPrefix(requiredVer, ">") && !strings.HasPrefix(requiredVer, "<") {
-		return requiredVer == actualVer
-	}
-
-	op := ""
-	verStr := requiredVer
-	switch {
-	case strings.HasPrefix(requiredVer, ">="):
-		op = ">="
-		verStr = strings.TrimPrefix(requiredVer, ">=")
-	case strings.HasPrefix(requiredVer, "<="):
-		op = "<="
-		verStr = strings.TrimPrefix(requiredVer, "<=")
-	case strings.HasPrefix(requiredVer, ">"):
-		op = ">"
-		verStr = strings.TrimPrefix(requiredVer, ">")
-	case strings.HasPrefix(requiredVer, "<"):
-		op = "<"
-		verStr = strings.TrimPrefix(requiredVer, "<")
-	}
-
-	switch op {
-	case ">=":
-		return compareVersions(actualVer, verStr) >= 0
-	case "<=":
-		return compareVersions(actualVer, verStr) <= 0
-	case ">":
-		return compareVersions(actualVer, verStr) > 0
-	case "<":
-		return compareVersions(actualVer, verStr) < 0
-	default:
-		return false // should not happen
+	if _, err := parseVersion(version); err != nil {
+		return "", fmt.Errorf("archive name %s: %w", archiveName, err)
 	}
+	return version, nil
 }
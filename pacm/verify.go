@@ -0,0 +1,141 @@
+package pacm
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// problems found by pm verify
+const (
+	verifyMissing    = "missing"
+	verifyModified   = "modified"
+	verifyMode       = "mode"
+	verifyUnexpected = "unexpected"
+)
+
+// VerifyIssue is a difference between the installed files and the database
+type VerifyIssue struct {
+	Package string
+	Path    string // absolute path of the file
+	Problem string // missing, modified, mode or unexpected
+}
+
+// VerifyPackages checks files of installed packages, all packages if names are empty
+func VerifyPackages(dbPath string, names []string) ([]VerifyIssue, error) {
+	db, err := readInstalledDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if db.find(name) == nil {
+			return nil, fmt.Errorf("package %s is not installed", name)
+		}
+	}
+
+	// directories with files of installed packages are not unexpected
+	owned := db.ownedFiles(nil)
+	for _, pkg := range db.Packages {
+		for _, f := range pkg.Files {
+			for dir := path.Dir(f.Path); dir != "."; dir = path.Dir(dir) {
+				owned[filepath.Join(pkg.Root, filepath.FromSlash(dir))] = true
+			}
+		}
+	}
+	var issues []VerifyIssue
+	for _, pkg := range db.Packages {
+		if len(names) > 0 && !slices.Contains(names, pkg.Name) {
+			continue
+		}
+		pkgIssues, err := pkg.verify(owned)
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", pkg.Name, err)
+		}
+		slog.Info("Verify package", "package", pkg.Name, "version", pkg.Ver, "files", len(pkg.Files), "issues", len(pkgIssues))
+		issues = append(issues, pkgIssues...)
+	}
+	return issues, nil
+}
+
+// verify rehashes files of the package and looks for files in its directories which no package owns
+func (pkg *InstalledPackage) verify(owned map[string]bool) ([]VerifyIssue, error) {
+	var issues []VerifyIssue
+	report := func(path, problem string) {
+		issues = append(issues, VerifyIssue{Package: pkg.Name, Path: path, Problem: problem})
+	}
+
+	dirs := make(map[string]bool)
+	for _, f := range pkg.Files {
+		p := filepath.Join(pkg.Root, filepath.FromSlash(f.Path))
+		if f.Type == fileTypeDir {
+			dirs[p] = true
+		} else if dir := filepath.Dir(p); dir != pkg.Root {
+			dirs[dir] = true
+		}
+
+		info, err := os.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			report(p, verifyMissing)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch f.Type {
+		case fileTypeDir:
+			if !info.IsDir() {
+				report(p, verifyModified)
+			}
+		case fileTypeSymlink:
+			if link, err := os.Readlink(p); err != nil || link != f.Link {
+				report(p, verifyModified)
+			}
+		case fileTypeHardlink:
+			target, err := os.Lstat(filepath.Join(pkg.Root, filepath.FromSlash(f.Link)))
+			if err != nil || !os.SameFile(info, target) {
+				report(p, verifyModified)
+			}
+		default:
+			if !info.Mode().IsRegular() {
+				report(p, verifyModified)
+				continue
+			}
+			sum, err := fileSHA256(p)
+			if err != nil {
+				return nil, err
+			}
+			if sum != f.SHA256 {
+				report(p, verifyModified)
+			} else if f.Mode != 0 && fileMode(info) != f.Mode {
+				report(p, verifyMode)
+			}
+		}
+	}
+
+	for _, dir := range slices.Sorted(maps.Keys(dirs)) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue // missing dir is reported above
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if owned[p] || dirs[p] || strings.HasPrefix(e.Name(), ".pacman-") {
+				continue
+			}
+			report(p, verifyUnexpected)
+		}
+	}
+	return issues, nil
+}
+
+// permission and special bits of the file as they are recorded in the database
+func fileMode(info os.FileInfo) os.FileMode {
+	return info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
@@ -0,0 +1,171 @@
+package pacm
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version (https://semver.org/spec/v2.0.0.html).
+// Release may have any number of numeric parts, missing parts are zero: 1.10 == 1.10.0
+type Version struct {
+	Release []int
+	Pre     []string // pre-release identifiers
+	Build   string   // build metadata, ignored for ordering
+}
+
+func parseVersion(s string) (Version, error) {
+	var v Version
+	if s == "" {
+		return v, fmt.Errorf("empty version")
+	}
+
+	rest := s
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		v.Build = rest[i+1:]
+		rest = rest[:i]
+		if !validIdentifiers(v.Build) {
+			return v, fmt.Errorf("invalid build metadata in version %q", s)
+		}
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		pre := rest[i+1:]
+		rest = rest[:i]
+		if !validIdentifiers(pre) {
+			return v, fmt.Errorf("invalid pre-release in version %q", s)
+		}
+		v.Pre = strings.Split(pre, ".")
+	}
+
+	for _, part := range strings.Split(rest, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part[0] == '+' {
+			return v, fmt.Errorf("invalid version %q: %q is not a number", s, part)
+		}
+		v.Release = append(v.Release, n)
+	}
+	return v, nil
+}
+
+// dot separated non empty identifiers of [0-9A-Za-z-]
+func validIdentifiers(s string) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, c := range id {
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (v Version) String() string {
+	parts := make([]string, 0, len(v.Release))
+	for _, n := range v.Release {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	s := strings.Join(parts, ".")
+	if len(v.Pre) > 0 {
+		s += "-" + strings.Join(v.Pre, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+func (v Version) IsPrerelease() bool {
+	return len(v.Pre) > 0
+}
+
+// Compare returns -1, 0 or 1 by semver precedence, build metadata is ignored
+func (v Version) Compare(o Version) int {
+	if c := compareRelease(v.Release, o.Release); c != 0 {
+		return c
+	}
+
+	// a version without pre-release has higher precedence
+	switch {
+	case len(v.Pre) == 0 && len(o.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		if c := compareIdentifiers(v.Pre[i], o.Pre[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.Pre) - len(o.Pre))
+}
+
+func compareRelease(r1, r2 []int) int {
+	for i := 0; i < len(r1) || i < len(r2); i++ {
+		var p1, p2 int
+		if i < len(r1) {
+			p1 = r1[i]
+		}
+		if i < len(r2) {
+			p2 = r2[i]
+		}
+		if c := sign(p1 - p2); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// numeric identifiers are compared numerically and have lower precedence than alphanumeric
+func compareIdentifiers(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return sign(na - nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// compareVersions compares version strings by semver precedence.
+// Invalid versions are lower than any valid version.
+func compareVersions(v1, v2 string) int {
+	ver1, err1 := parseVersion(v1)
+	if err1 != nil {
+		slog.Warn("compareVersions: can't parse version", "version", v1, "error", err1)
+	}
+	ver2, err2 := parseVersion(v2)
+	if err2 != nil {
+		slog.Warn("compareVersions: can't parse version", "version", v2, "error", err2)
+	}
+
+	switch {
+	case err1 != nil && err2 != nil:
+		return strings.Compare(v1, v2)
+	case err1 != nil:
+		return -1
+	case err2 != nil:
+		return 1
+	}
+	return ver1.Compare(ver2)
+}